@@ -3,13 +3,49 @@ package directory
 import (
 	"crypto/sha256"
 	"encoding/hex"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 
+	"github.com/containers/image/pkg/compression"
 	"github.com/containers/image/types"
 )
 
+// startDiffIDComputation returns a reader which yields exactly the same bytes as compressedSrc
+// (still compressed with algo) while, in the background, computing the sha256 digest of its
+// decompressed contents. The result function must only be called after the returned reader has
+// been fully drained by the caller; it then blocks until the background decompression has caught
+// up and returns the resulting DiffID. If the caller instead abandons the reader before EOF (e.g.
+// because writing it out failed), it must call the abort function instead, or the background
+// goroutine is left blocked forever waiting for bytes that will never come.
+func startDiffIDComputation(compressedSrc io.Reader, algo compression.Algorithm) (io.Reader, func() (string, error), func()) {
+	pr, pw := io.Pipe()
+	tee := io.TeeReader(compressedSrc, pw)
+	h := sha256.New()
+	done := make(chan error, 1)
+	go func() {
+		dec, err := compression.NewDecompressor(algo, pr)
+		if err != nil {
+			pr.CloseWithError(err)
+			done <- err
+			return
+		}
+		_, err = io.Copy(h, dec)
+		dec.Close()
+		done <- err
+	}()
+	result := func() (string, error) {
+		pw.Close()
+		if err := <-done; err != nil {
+			return "", err
+		}
+		return "sha256:" + hex.EncodeToString(h.Sum(nil)), nil
+	}
+	abort := func() { pw.CloseWithError(fmt.Errorf("DiffID computation aborted after a downstream error")) }
+	return tee, result, abort
+}
+
 type dirImageDestination struct {
 	ref dirReference
 }
@@ -35,11 +71,15 @@ func (d *dirImageDestination) PutManifest(manifest []byte) error {
 
 // PutBlob writes contents of stream and returns its computed digest and size (both if can be computed).
 // A digest can be optionally provided if known, the specific image destination can decide to play with it or not.
+// If options.DesiredCompression is not compression.Uncompressed and differs from the compression the stream is
+// actually using, PutBlob transcodes on the fly by streaming decompression straight into recompression through
+// an io.Pipe, so the whole layer never sits in memory; the returned digest is always of the bytes actually
+// written to disk. If options.DiffID is not nil, it receives the digest of stream's decompressed contents.
 // WARNING: The contents of stream are being verified on the fly.  Until stream.Read() returns io.EOF, the contents of the data SHOULD NOT be available
 // to any other readers for download using the supplied digest.
 // If stream.Read() at any time, ESPECIALLY at end of input, returns an error, PutBlob MUST 1) fail, and 2) delete any data stored so far.
 // Note: Calling PutBlob() and other methods may have ordering dependencies WRT other methods of this type. FIXME: Figure out and document.
-func (d *dirImageDestination) PutBlob(stream io.Reader, digest string) (string, int64, error) {
+func (d *dirImageDestination) PutBlob(stream io.Reader, digest string, options types.PutBlobOptions) (string, int64, error) {
 	blobFile, err := ioutil.TempFile(d.ref.path, "dir-put-blob")
 	if err != nil {
 		return "", -1, err
@@ -52,11 +92,59 @@ func (d *dirImageDestination) PutBlob(stream io.Reader, digest string) (string,
 		}
 	}()
 
+	srcCompression, detected, err := compression.DetectCompression(stream)
+	if err != nil {
+		return "", -1, fmt.Errorf("Error detecting compression of blob: %v", err)
+	}
+
+	src := detected
+	var diffIDResult func() (string, error)
+	var abortDiffID func()
+	if options.DesiredCompression != compression.Uncompressed && options.DesiredCompression != srcCompression {
+		dec, err := compression.NewDecompressor(srcCompression, detected)
+		if err != nil {
+			return "", -1, fmt.Errorf("Error decompressing blob: %v", err)
+		}
+		defer dec.Close()
+
+		diffIDHash := sha256.New()
+		pr, pw := io.Pipe()
+		enc, err := compression.NewCompressor(options.DesiredCompression, pw)
+		if err != nil {
+			return "", -1, fmt.Errorf("Error recompressing blob to %s: %v", options.DesiredCompression, err)
+		}
+		go func() {
+			_, copyErr := io.Copy(enc, io.TeeReader(dec, diffIDHash))
+			closeErr := enc.Close()
+			if copyErr != nil {
+				pw.CloseWithError(copyErr)
+				return
+			}
+			pw.CloseWithError(closeErr)
+		}()
+		src = pr
+		diffIDResult = func() (string, error) { return "sha256:" + hex.EncodeToString(diffIDHash.Sum(nil)), nil }
+		// If the caller downstream of src (pr) stops reading before EOF, the goroutine above is
+		// left blocked writing into pw forever; unblock it by forcing its writes to fail.
+		abortDiffID = func() { pw.CloseWithError(fmt.Errorf("PutBlob: aborting recompression after a downstream error")) }
+	} else if srcCompression != compression.Uncompressed && options.DiffID != nil {
+		src, diffIDResult, abortDiffID = startDiffIDComputation(detected, srcCompression)
+	} else if options.DiffID != nil {
+		// Already uncompressed: its DiffID is just its own digest, computed below as src is
+		// written out.
+		diffIDHash := sha256.New()
+		src = io.TeeReader(detected, diffIDHash)
+		diffIDResult = func() (string, error) { return "sha256:" + hex.EncodeToString(diffIDHash.Sum(nil)), nil }
+	}
+
 	h := sha256.New()
-	tee := io.TeeReader(stream, h)
+	tee := io.TeeReader(src, h)
 
 	size, err := io.Copy(blobFile, tee)
 	if err != nil {
+		if abortDiffID != nil {
+			abortDiffID()
+		}
 		return "", -1, err
 	}
 	if err := blobFile.Sync(); err != nil {
@@ -65,15 +153,42 @@ func (d *dirImageDestination) PutBlob(stream io.Reader, digest string) (string,
 	if err := blobFile.Chmod(0644); err != nil {
 		return "", -1, err
 	}
+	if diffIDResult != nil {
+		// The caller has now fully drained tee, so the background goroutine computing the DiffID
+		// (if any) has seen all the bytes it needs and this won't block.
+		diffID, err := diffIDResult()
+		if err != nil {
+			return "", -1, fmt.Errorf("Error computing DiffID of blob: %v", err)
+		}
+		if options.DiffID != nil {
+			*options.DiffID = diffID
+		}
+	}
 	computedDigest := hex.EncodeToString(h.Sum(nil))
 	blobPath := d.ref.layerPath(computedDigest)
 	if err := os.Rename(blobFile.Name(), blobPath); err != nil {
 		return "", -1, err
 	}
 	succeeded = true
+	if options.Cache != nil {
+		options.Cache.RecordKnownLocation("dir", d.ref.path, computedDigest, blobPath)
+	}
 	return computedDigest, size, nil
 }
 
+// HasBlob returns true and the blob's size if a blob matching digest is already present in the
+// destination directory, so callers can avoid re-streaming a layer they already copied.
+func (d *dirImageDestination) HasBlob(digest string) (bool, int64, error) {
+	fi, err := os.Stat(d.ref.layerPath(digest))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, -1, nil
+		}
+		return false, -1, err
+	}
+	return true, fi.Size(), nil
+}
+
 func (d *dirImageDestination) PutSignatures(signatures [][]byte) error {
 	for i, sig := range signatures {
 		if err := ioutil.WriteFile(d.ref.signaturePath(i), sig, 0644); err != nil {
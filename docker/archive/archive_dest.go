@@ -0,0 +1,269 @@
+// Package archive implements the docker-archive transport: reading and writing the tar layout
+// produced and consumed by `docker save`/`docker load` — a top-level manifest.json naming each
+// image's config and ordered layers, the image config at "<hex>.json", and each layer's
+// *uncompressed* tar at "<diffID>/layer.tar" (alongside a VERSION file), so that the config's
+// rootfs.diff_ids line up with the directories docker load finds them in.
+package archive
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/containers/image/manifest"
+	"github.com/containers/image/pkg/compression"
+	"github.com/containers/image/types"
+)
+
+// tarManifestItem is one element of the top-level manifest.json written by `docker save` and
+// read by `docker load`.
+type tarManifestItem struct {
+	Config   string   `json:"Config"`
+	RepoTags []string `json:"RepoTags,omitempty"`
+	Layers   []string `json:"Layers"`
+}
+
+// archiveImageDestination stages a docker-save-style directory layout in a temporary directory
+// and only assembles it into the final tar file once PutManifest is called, mirroring the
+// "succeeded bool + deferred cleanup" pattern used by dirImageDestination.PutBlob.
+type archiveImageDestination struct {
+	ref      archiveReference
+	stageDir string
+	blobs    map[string]stagedBlob // digest -> staged blob, for blobs PutManifest has not yet classified as the config or a layer
+}
+
+// stagedBlob is a blob PutBlob has written to disk but PutManifest has not yet classified.
+type stagedBlob struct {
+	path string // staged path: the config JSON verbatim, or a layer's *decompressed* tar contents
+	// diffID is the digest of path's contents. For the config blob this is meaningless and unused;
+	// for a layer it is what the directory holding layer.tar must be named, so it lines up with the
+	// image config's rootfs.diff_ids.
+	diffID string
+}
+
+// newImageDestination returns an ImageDestination for writing to a docker-archive tar file.
+func newImageDestination(ref archiveReference) (types.ImageDestination, error) {
+	stageDir, err := ioutil.TempDir("", "docker-archive-put")
+	if err != nil {
+		return nil, err
+	}
+	return &archiveImageDestination{ref: ref, stageDir: stageDir, blobs: map[string]stagedBlob{}}, nil
+}
+
+func (d *archiveImageDestination) Reference() types.ImageReference {
+	return d.ref
+}
+
+func (d *archiveImageDestination) SupportedManifestMIMETypes() []string {
+	return []string{manifest.DockerV2Schema2MIMEType}
+}
+
+// PutBlob stages stream inside the temporary docker-save layout; the file is only renamed into
+// place once its contents are fully and successfully written, so a failure partway through never
+// leaves a half-written blob behind. Whether the blob is the config or a layer isn't known yet at
+// this point (PutBlob doesn't say), so it is recorded by digest and only classified once
+// PutManifest sees which digest is which. The returned digest and size always describe stream
+// exactly as received (matching what the manifest that references it will say); if stream turns
+// out to be a compressed layer, what actually gets staged to disk is its *decompressed* contents,
+// since that is what docker load's layer.tar is expected to hold.
+func (d *archiveImageDestination) PutBlob(stream io.Reader, _ string, options types.PutBlobOptions) (string, int64, error) {
+	srcCompression, detected, err := compression.DetectCompression(stream)
+	if err != nil {
+		return "", -1, fmt.Errorf("Error detecting compression of blob: %v", err)
+	}
+	counted := &countingReader{r: detected}
+	h := sha256.New()
+	tee := io.TeeReader(counted, h) // hashes and counts exactly the bytes PutBlob received, for the digest/size it returns
+
+	diffIDHash := sha256.New()
+	var src io.Reader
+	if srcCompression != compression.Uncompressed {
+		dec, err := compression.NewDecompressor(srcCompression, tee)
+		if err != nil {
+			return "", -1, fmt.Errorf("Error decompressing blob: %v", err)
+		}
+		defer dec.Close()
+		src = io.TeeReader(dec, diffIDHash)
+	} else {
+		src = io.TeeReader(tee, diffIDHash) // already uncompressed, so its DiffID is its own digest
+	}
+
+	tmp, err := ioutil.TempFile(d.stageDir, "blob")
+	if err != nil {
+		return "", -1, err
+	}
+	succeeded := false
+	defer func() {
+		tmp.Close()
+		if !succeeded {
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	if _, err := io.Copy(tmp, src); err != nil {
+		return "", -1, err
+	}
+	if err := tmp.Sync(); err != nil {
+		return "", -1, err
+	}
+
+	digest := "sha256:" + hex.EncodeToString(h.Sum(nil))
+	diffID := "sha256:" + hex.EncodeToString(diffIDHash.Sum(nil))
+	blobPath := filepath.Join(d.stageDir, strings.TrimPrefix(digest, "sha256:")+".blob")
+	if err := os.Rename(tmp.Name(), blobPath); err != nil {
+		return "", -1, err
+	}
+	succeeded = true
+
+	d.blobs[digest] = stagedBlob{path: blobPath, diffID: diffID}
+	return digest, counted.n, nil
+}
+
+// countingReader wraps r, counting the bytes actually read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// PutManifest converts the Docker v2s2 manifest m into the manifest.json layout docker load
+// expects: the staged blob matching m's config digest is placed at "<hex>.json", each staged
+// layer blob matching one of m's layer digests is placed at "<diffID>/layer.tar" (in manifest
+// order, with the DiffID PutBlob computed for it, not its possibly-compressed manifest digest),
+// and the whole staging directory is then tarred up into the final archive in one atomic rename.
+func (d *archiveImageDestination) PutManifest(m []byte) error {
+	var s2 struct {
+		Config manifest.Schema2Descriptor   `json:"config"`
+		Layers []manifest.Schema2Descriptor `json:"layers"`
+	}
+	if err := json.Unmarshal(m, &s2); err != nil {
+		return err
+	}
+
+	config, ok := d.blobs[s2.Config.Digest]
+	if !ok {
+		return fmt.Errorf("config blob %s was not written via PutBlob", s2.Config.Digest)
+	}
+	configName := strings.TrimPrefix(s2.Config.Digest, "sha256:") + ".json"
+	if err := os.Rename(config.path, filepath.Join(d.stageDir, configName)); err != nil {
+		return err
+	}
+	delete(d.blobs, s2.Config.Digest)
+
+	layers := make([]string, len(s2.Layers))
+	for i, l := range s2.Layers {
+		layer, ok := d.blobs[l.Digest]
+		if !ok {
+			return fmt.Errorf("layer blob %s was not written via PutBlob", l.Digest)
+		}
+		diffID := strings.TrimPrefix(layer.diffID, "sha256:")
+		layerDir := filepath.Join(d.stageDir, diffID)
+		if err := os.MkdirAll(layerDir, 0755); err != nil {
+			return err
+		}
+		if err := os.Rename(layer.path, filepath.Join(layerDir, "layer.tar")); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(filepath.Join(layerDir, "VERSION"), []byte("1.0"), 0644); err != nil {
+			return err
+		}
+		delete(d.blobs, l.Digest)
+		layers[i] = diffID + "/layer.tar"
+	}
+
+	item := tarManifestItem{
+		Config: configName,
+		Layers: layers,
+	}
+	if d.ref.destinationRef != nil {
+		item.RepoTags = []string{d.ref.destinationRef.String()}
+	}
+	items := []tarManifestItem{item}
+	itemsJSON, err := json.Marshal(items)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(d.stageDir, "manifest.json"), itemsJSON, 0644); err != nil {
+		return err
+	}
+
+	return d.commit()
+}
+
+// commit tars up the staging directory into the final archive path, using a temporary file plus
+// rename so a reader of d.ref.path never observes a partially-written archive.
+func (d *archiveImageDestination) commit() error {
+	tmp, err := ioutil.TempFile(filepath.Dir(d.ref.path), "docker-archive-commit")
+	if err != nil {
+		return err
+	}
+	succeeded := false
+	defer func() {
+		tmp.Close()
+		if !succeeded {
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	tw := tar.NewWriter(tmp)
+	err = filepath.Walk(d.stageDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(d.stageDir, path)
+		if err != nil {
+			return err
+		}
+		hdr, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = rel
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp.Name(), d.ref.path); err != nil {
+		return err
+	}
+	succeeded = true
+	os.RemoveAll(d.stageDir)
+	return nil
+}
+
+func (d *archiveImageDestination) PutSignatures(signatures [][]byte) error {
+	if len(signatures) != 0 {
+		return errNotSupported("pushing signatures for docker-archive images")
+	}
+	return nil
+}
+
+type errNotSupported string
+
+func (e errNotSupported) Error() string { return string(e) + " is not supported" }
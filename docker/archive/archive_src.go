@@ -0,0 +1,183 @@
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/containers/image/manifest"
+	"github.com/containers/image/types"
+)
+
+// archiveImageSource reads a docker-save-style tar file. Because the tar format isn't seekable in
+// general, every lookup (manifestItem, getBlobByName) re-opens and re-scans the file for the
+// entry it needs; this trades a little I/O for not having to hold the whole archive open or
+// buffered in memory between calls.
+type archiveImageSource struct {
+	ref archiveReference
+}
+
+func newImageSource(ref archiveReference) (types.ImageSource, error) {
+	return &archiveImageSource{ref: ref}, nil
+}
+
+func (s *archiveImageSource) Reference() types.ImageReference {
+	return s.ref
+}
+
+func (s *archiveImageSource) IntendedDockerReference() string {
+	if s.ref.destinationRef == nil {
+		return ""
+	}
+	return s.ref.destinationRef.String()
+}
+
+func (s *archiveImageSource) manifestItem() (tarManifestItem, error) {
+	f, err := os.Open(s.ref.path)
+	if err != nil {
+		return tarManifestItem{}, err
+	}
+	defer f.Close()
+
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return tarManifestItem{}, fmt.Errorf("docker-archive: manifest.json not found in %s", s.ref.path)
+		}
+		if err != nil {
+			return tarManifestItem{}, err
+		}
+		if hdr.Name != "manifest.json" {
+			continue
+		}
+		var items []tarManifestItem
+		if err := json.NewDecoder(tr).Decode(&items); err != nil {
+			return tarManifestItem{}, err
+		}
+		if len(items) == 0 {
+			return tarManifestItem{}, fmt.Errorf("docker-archive: manifest.json in %s is empty", s.ref.path)
+		}
+		return items[0], nil // a single-image archive; picking among several by tag is a future enhancement
+	}
+}
+
+// getBlobByName returns the contents of a file inside the archive by its tar path, e.g.
+// "<diffID>/layer.tar" or "<configDigest>.json".
+func (s *archiveImageSource) getBlobByName(name string) ([]byte, error) {
+	f, err := os.Open(s.ref.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil, fmt.Errorf("docker-archive: %s not found in %s", name, s.ref.path)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Name == name {
+			return ioutil.ReadAll(tr)
+		}
+	}
+}
+
+// GetManifest reconstructs a Docker v2s2 manifest from manifest.json and the config/layer blobs it
+// references; docker-archive tars don't carry a v2s2 manifest of their own.
+func (s *archiveImageSource) GetManifest(mimetypes []string) ([]byte, string, error) {
+	item, err := s.manifestItem()
+	if err != nil {
+		return nil, "", err
+	}
+
+	configBytes, err := s.getBlobByName(item.Config)
+	if err != nil {
+		return nil, "", err
+	}
+	configDigest, err := manifest.Digest(configBytes)
+	if err != nil {
+		return nil, "", err
+	}
+
+	m := struct {
+		SchemaVersion int                          `json:"schemaVersion"`
+		MediaType     string                       `json:"mediaType"`
+		Config        manifest.Schema2Descriptor   `json:"config"`
+		Layers        []manifest.Schema2Descriptor `json:"layers"`
+	}{
+		SchemaVersion: 2,
+		MediaType:     manifest.DockerV2Schema2MediaType,
+		Config: manifest.Schema2Descriptor{
+			MediaType: manifest.DockerV2Schema2ConfigMediaType,
+			Size:      int64(len(configBytes)),
+			Digest:    configDigest,
+		},
+	}
+	for _, layerName := range item.Layers {
+		layerBytes, err := s.getBlobByName(layerName)
+		if err != nil {
+			return nil, "", err
+		}
+		m.Layers = append(m.Layers, manifest.Schema2Descriptor{
+			MediaType: manifest.DockerV2Schema2LayerMediaType,
+			Size:      int64(len(layerBytes)),
+			Digest:    "sha256:" + layerDiffID(layerName),
+		})
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		return nil, "", err
+	}
+	return b, m.MediaType, nil
+}
+
+// GetBlob finds a blob previously described by GetManifest, by digest, inside the archive.
+func (s *archiveImageSource) GetBlob(digest string) (io.ReadCloser, int64, error) {
+	item, err := s.manifestItem()
+	if err != nil {
+		return nil, 0, err
+	}
+	for _, layerName := range item.Layers {
+		if "sha256:"+layerDiffID(layerName) == digest {
+			data, err := s.getBlobByName(layerName)
+			if err != nil {
+				return nil, 0, err
+			}
+			return ioutil.NopCloser(bytes.NewReader(data)), int64(len(data)), nil
+		}
+	}
+	configBytes, err := s.getBlobByName(item.Config)
+	if err != nil {
+		return nil, 0, err
+	}
+	if configDigest, err := manifest.Digest(configBytes); err == nil && configDigest == digest {
+		return ioutil.NopCloser(bytes.NewReader(configBytes)), int64(len(configBytes)), nil
+	}
+	return nil, 0, fmt.Errorf("docker-archive: blob %s not found in %s", digest, s.ref.path)
+}
+
+func (s *archiveImageSource) GetSignatures() ([][]byte, error) {
+	return [][]byte{}, nil
+}
+
+func (s *archiveImageSource) Delete() error {
+	return fmt.Errorf("docker-archive: deleting images is not supported")
+}
+
+// layerDiffID extracts "<diffID>" out of a tar path of the form "<diffID>/layer.tar".
+func layerDiffID(tarPath string) string {
+	for i := 0; i < len(tarPath); i++ {
+		if tarPath[i] == '/' {
+			return tarPath[:i]
+		}
+	}
+	return tarPath
+}
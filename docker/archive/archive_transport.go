@@ -0,0 +1,81 @@
+package archive
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/containers/image/reference"
+	"github.com/containers/image/types"
+)
+
+// Transport is an ImageTransport for docker-archive tar files.
+var Transport = archiveTransport{}
+
+type archiveTransport struct{}
+
+func (t archiveTransport) Name() string {
+	return "docker-archive"
+}
+
+// ParseReference converts a docker-archive reference string, of the form
+// "<path>[:<docker-reference>]", into an ImageReference.
+func (t archiveTransport) ParseReference(ref string) (types.ImageReference, error) {
+	parts := strings.SplitN(ref, ":", 2)
+	path := parts[0]
+	var destinationRef reference.Named
+	if len(parts) == 2 {
+		named, err := reference.ParseNormalizedNamed(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("docker-archive: invalid reference %q: %v", parts[1], err)
+		}
+		destinationRef = named
+	}
+	return NewReference(path, destinationRef)
+}
+
+// archiveReference is an ImageReference for a docker-archive tar file, optionally tagged with the
+// docker reference the image inside it should be recorded under (used when writing a manifest.json
+// with RepoTags). Reading always uses the first image listed in the archive's manifest.json,
+// whatever destinationRef says.
+type archiveReference struct {
+	path           string
+	destinationRef reference.Named
+}
+
+// NewReference returns an ImageReference for the docker-archive tar file at path, optionally
+// associated with destinationRef (may be nil, e.g. for a read-only reference to an archive whose
+// tags should be taken as-is).
+func NewReference(path string, destinationRef reference.Named) (types.ImageReference, error) {
+	return archiveReference{path: path, destinationRef: destinationRef}, nil
+}
+
+func (ref archiveReference) Transport() types.ImageTransport {
+	return Transport
+}
+
+func (ref archiveReference) StringWithinTransport() string {
+	if ref.destinationRef == nil {
+		return ref.path
+	}
+	return fmt.Sprintf("%s:%s", ref.path, ref.destinationRef.String())
+}
+
+func (ref archiveReference) DockerReference() reference.Named {
+	return ref.destinationRef
+}
+
+func (ref archiveReference) NewImage(certPath string, tlsVerify bool) (types.Image, error) {
+	return nil, fmt.Errorf("docker-archive: NewImage is not supported, use NewImageSource instead")
+}
+
+func (ref archiveReference) NewImageSource(certPath string, tlsVerify bool) (types.ImageSource, error) {
+	return newImageSource(ref)
+}
+
+func (ref archiveReference) NewImageDestination(certPath string, tlsVerify bool) (types.ImageDestination, error) {
+	return newImageDestination(ref)
+}
+
+func (ref archiveReference) DeleteImage(certPath string, tlsVerify bool) error {
+	return fmt.Errorf("docker-archive: deleting images is not supported")
+}
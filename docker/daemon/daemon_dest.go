@@ -0,0 +1,88 @@
+package daemon
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/containers/image/docker/archive"
+	"github.com/containers/image/types"
+)
+
+// daemonImageDestination builds a docker-archive tar in a temporary file as blobs and the
+// manifest come in, then streams it straight into the daemon's /images/load endpoint in
+// PutManifest, without ever buffering the whole tar in memory.
+type daemonImageDestination struct {
+	ref     daemonReference
+	archive types.ImageDestination // a docker-archive destination backed by a temporary file
+	tmpPath string
+	client  *http.Client
+}
+
+func newImageDestination(ref daemonReference) (types.ImageDestination, error) {
+	tmp, err := tempArchivePath()
+	if err != nil {
+		return nil, err
+	}
+	archiveRef, err := archive.NewReference(tmp, ref.ref)
+	if err != nil {
+		return nil, err
+	}
+	archiveDest, err := archiveRef.NewImageDestination("", false)
+	if err != nil {
+		return nil, err
+	}
+	return &daemonImageDestination{
+		ref:     ref,
+		archive: archiveDest,
+		tmpPath: tmp,
+		client:  newDockerDaemonClient(),
+	}, nil
+}
+
+func (d *daemonImageDestination) Reference() types.ImageReference {
+	return d.ref
+}
+
+func (d *daemonImageDestination) SupportedManifestMIMETypes() []string {
+	return d.archive.SupportedManifestMIMETypes()
+}
+
+func (d *daemonImageDestination) PutBlob(stream io.Reader, digest string, options types.PutBlobOptions) (string, int64, error) {
+	return d.archive.PutBlob(stream, digest, options)
+}
+
+func (d *daemonImageDestination) PutSignatures(signatures [][]byte) error {
+	return d.archive.PutSignatures(signatures)
+}
+
+// PutManifest finishes assembling the docker-archive tar, then streams it directly into the
+// daemon's POST /images/load, so the full image never has to be buffered in this process beyond
+// what's already on disk in the staged tar.
+func (d *daemonImageDestination) PutManifest(m []byte) error {
+	if err := d.archive.PutManifest(m); err != nil {
+		return err
+	}
+
+	f, err := openForStreaming(d.tmpPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	defer removeTempArchive(d.tmpPath)
+
+	req, err := http.NewRequest("POST", "http://docker/images/load", f)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-tar")
+	res, err := d.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("Error loading image into Docker daemon: %v", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("Error loading image into Docker daemon, status %d", res.StatusCode)
+	}
+	return nil
+}
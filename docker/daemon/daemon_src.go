@@ -0,0 +1,89 @@
+package daemon
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+
+	"github.com/containers/image/docker/archive"
+	"github.com/containers/image/types"
+)
+
+// daemonImageSource fetches ref out of the local Docker daemon via GET /images/get once, streams
+// it straight to a temporary docker-save tar on disk, and then delegates every actual read to a
+// docker-archive source over that file.
+type daemonImageSource struct {
+	ref     daemonReference
+	archive types.ImageSource
+	tmpPath string
+}
+
+func newImageSource(ref daemonReference) (types.ImageSource, error) {
+	tmp, err := tempArchivePath()
+	if err != nil {
+		return nil, err
+	}
+
+	client := newDockerDaemonClient()
+	getURL := fmt.Sprintf("http://docker/images/get?names=%s", url.QueryEscape(ref.ref.String()))
+	res, err := client.Get(getURL)
+	if err != nil {
+		removeTempArchive(tmp)
+		return nil, fmt.Errorf("Error requesting image from Docker daemon: %v", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		removeTempArchive(tmp)
+		return nil, fmt.Errorf("Error requesting image from Docker daemon, status %d", res.StatusCode)
+	}
+
+	f, err := openForWriting(tmp)
+	if err != nil {
+		removeTempArchive(tmp)
+		return nil, err
+	}
+	_, err = io.Copy(f, res.Body)
+	f.Close()
+	if err != nil {
+		removeTempArchive(tmp)
+		return nil, fmt.Errorf("Error streaming image from Docker daemon to %s: %v", tmp, err)
+	}
+
+	archiveRef, err := archive.NewReference(tmp, ref.ref)
+	if err != nil {
+		removeTempArchive(tmp)
+		return nil, err
+	}
+	archiveSrc, err := archiveRef.NewImageSource("", false)
+	if err != nil {
+		removeTempArchive(tmp)
+		return nil, err
+	}
+	return &daemonImageSource{ref: ref, archive: archiveSrc, tmpPath: tmp}, nil
+}
+
+func (s *daemonImageSource) Reference() types.ImageReference {
+	return s.ref
+}
+
+func (s *daemonImageSource) IntendedDockerReference() string {
+	return s.ref.ref.String()
+}
+
+func (s *daemonImageSource) GetManifest(mimetypes []string) ([]byte, string, error) {
+	return s.archive.GetManifest(mimetypes)
+}
+
+func (s *daemonImageSource) GetBlob(digest string) (io.ReadCloser, int64, error) {
+	return s.archive.GetBlob(digest)
+}
+
+func (s *daemonImageSource) GetSignatures() ([][]byte, error) {
+	return s.archive.GetSignatures()
+}
+
+func (s *daemonImageSource) Delete() error {
+	removeTempArchive(s.tmpPath)
+	return s.archive.Delete()
+}
@@ -0,0 +1,86 @@
+// Package daemon implements the docker-daemon transport: streaming image tars in and out of the
+// local Docker daemon over its Engine API, via /var/run/docker.sock, instead of a registry.
+package daemon
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/containers/image/reference"
+	"github.com/containers/image/types"
+)
+
+// defaultDockerSocket is where the Docker daemon listens by default on Linux.
+const defaultDockerSocket = "/var/run/docker.sock"
+
+// Transport is an ImageTransport for images known to the local Docker daemon.
+var Transport = daemonTransport{}
+
+type daemonTransport struct{}
+
+func (t daemonTransport) Name() string {
+	return "docker-daemon"
+}
+
+// ParseReference converts a docker-daemon reference string (a docker image name, e.g.
+// "busybox:latest" or an image ID) into an ImageReference.
+func (t daemonTransport) ParseReference(ref string) (types.ImageReference, error) {
+	named, err := reference.ParseNormalizedNamed(ref)
+	if err != nil {
+		return nil, fmt.Errorf("docker-daemon: invalid reference %q: %v", ref, err)
+	}
+	return NewReference(named)
+}
+
+// daemonReference is an ImageReference for an image known to the local Docker daemon, identified
+// the same way `docker` itself identifies it: by name[:tag] or ID.
+type daemonReference struct {
+	ref reference.Named
+}
+
+// NewReference returns an ImageReference for the image ref as known to the local Docker daemon.
+func NewReference(ref reference.Named) (types.ImageReference, error) {
+	return daemonReference{ref: ref}, nil
+}
+
+func (ref daemonReference) Transport() types.ImageTransport {
+	return Transport
+}
+
+func (ref daemonReference) StringWithinTransport() string {
+	return ref.ref.String()
+}
+
+func (ref daemonReference) DockerReference() reference.Named {
+	return ref.ref
+}
+
+func (ref daemonReference) NewImage(certPath string, tlsVerify bool) (types.Image, error) {
+	return nil, fmt.Errorf("docker-daemon: NewImage is not supported, use NewImageSource instead")
+}
+
+func (ref daemonReference) NewImageSource(certPath string, tlsVerify bool) (types.ImageSource, error) {
+	return newImageSource(ref)
+}
+
+func (ref daemonReference) NewImageDestination(certPath string, tlsVerify bool) (types.ImageDestination, error) {
+	return newImageDestination(ref)
+}
+
+func (ref daemonReference) DeleteImage(certPath string, tlsVerify bool) error {
+	return fmt.Errorf("docker-daemon: deleting images is not supported")
+}
+
+// newDockerDaemonClient returns an *http.Client talking to the local Docker daemon's UNIX socket,
+// so callers can issue plain http.NewRequest calls against a fake "http://docker" base URL.
+func newDockerDaemonClient() *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			Dial: func(_, _ string) (net.Conn, error) {
+				return net.DialTimeout("unix", defaultDockerSocket, 32*time.Second)
+			},
+		},
+	}
+}
@@ -0,0 +1,30 @@
+package daemon
+
+import (
+	"io/ioutil"
+	"os"
+)
+
+// tempArchivePath reserves a temporary file to stage a docker-save-style tar in, without
+// actually creating any content in it yet.
+func tempArchivePath() (string, error) {
+	f, err := ioutil.TempFile("", "docker-daemon-archive")
+	if err != nil {
+		return "", err
+	}
+	path := f.Name()
+	f.Close()
+	return path, nil
+}
+
+func openForStreaming(path string) (*os.File, error) {
+	return os.Open(path)
+}
+
+func openForWriting(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_WRONLY|os.O_TRUNC, 0644)
+}
+
+func removeTempArchive(path string) {
+	os.Remove(path)
+}
@@ -0,0 +1,390 @@
+package docker
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/containers/image/manifest"
+	"github.com/containers/image/pkg/blobinfocache"
+	"github.com/containers/image/reference"
+	"github.com/containers/image/types"
+)
+
+// defaultChunkSize is used when no chunk size is configured on the destination; it balances
+// keeping a single PATCH small enough to retry cheaply against not making too many round trips.
+const defaultChunkSize = 10 * 1024 * 1024 // 10 MiB
+
+// blobUploadURL is the registry endpoint used to start (and, with ?mount=&from=, cross-repo-mount) a blob upload.
+const blobUploadURL = "/v2/%s/blobs/uploads/"
+
+type dockerImageDestination struct {
+	ref       reference.Named
+	tag       string
+	c         *dockerClient
+	chunkSize int64
+	// manifestDigest is set by PutManifest and consumed by PutSignatures, since pushing
+	// signatures to the sigstore lookaside needs the digest of the manifest they're attached to.
+	manifestDigest string
+}
+
+// newDockerImageDestination is the same as NewDockerImageDestination, only it returns the more specific *dockerImageDestination type.
+func newDockerImageDestination(img, certPath string, tlsVerify bool) (*dockerImageDestination, error) {
+	ref, tag, err := parseDockerImageName(img)
+	if err != nil {
+		return nil, err
+	}
+	c, err := newDockerClient(ref.Hostname(), certPath, tlsVerify)
+	if err != nil {
+		return nil, err
+	}
+	return &dockerImageDestination{
+		ref:       ref,
+		tag:       tag,
+		c:         c,
+		chunkSize: defaultChunkSize,
+	}, nil
+}
+
+// NewDockerImageDestination creates a new ImageDestination for the specified image and connection specification.
+func NewDockerImageDestination(img, certPath string, tlsVerify bool) (types.ImageDestination, error) {
+	return newDockerImageDestination(img, certPath, tlsVerify)
+}
+
+func (d *dockerImageDestination) Reference() types.ImageReference {
+	return nil // FIXME: wrap d.ref/d.tag in a types.ImageReference once one exists for this transport.
+}
+
+func (d *dockerImageDestination) SupportedManifestMIMETypes() []string {
+	return nil
+}
+
+func (d *dockerImageDestination) PutManifest(m []byte) error {
+	digest, err := manifest.Digest(m)
+	if err != nil {
+		return err
+	}
+	d.manifestDigest = digest
+
+	url := fmt.Sprintf(manifestURL, d.ref.RemoteName(), d.tag)
+	res, err := d.c.makeRequest("PUT", url, nil, bytes.NewReader(m))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusCreated && res.StatusCode != http.StatusAccepted {
+		return fmt.Errorf("Error uploading manifest, status %d", res.StatusCode)
+	}
+	return nil
+}
+
+// PutBlob uploads stream as a blob, using the registry's chunked-upload protocol: it first tries
+// a cross-repo mount (cheap, no data transferred) if digest is already known to exist in some
+// other repository on this registry, then falls back to POST .../blobs/uploads/ -> repeated PATCH
+// with Content-Range -> PUT ?digest=. Each PATCH's response Location/Range headers are honored for
+// the next chunk, and a failed PATCH is resumed, not restarted, by re-GETting Location to discover
+// how much the registry actually received and re-sending only the unconfirmed suffix of that
+// chunk. If options.Cache already knows a location for digest in this repository, PutBlob skips
+// the upload entirely.
+//
+// options.Cache entries are recorded per-registry (not per-repository), since a cross-repo mount
+// can only source a blob from a *different* repository on the *same* registry.
+func (d *dockerImageDestination) PutBlob(stream io.Reader, digest string, options types.PutBlobOptions) (string, int64, error) {
+	if digest != "" {
+		if options.Cache != nil && len(options.Cache.CandidateLocations("docker", d.ref.Hostname(), digest)) > 0 {
+			if has, size, err := d.HasBlob(digest); err == nil && has {
+				return digest, size, nil
+			}
+		}
+		if from, ok := d.otherRepoWithBlob(digest, options.Cache); ok {
+			if mounted, err := d.tryCrossRepoMount(digest, from); err != nil {
+				logrus.Debugf("cross-repo mount of %s from %s failed, falling back to upload: %v", digest, from, err)
+			} else if mounted {
+				size, err := d.blobSize(digest)
+				if err == nil && options.Cache != nil {
+					options.Cache.RecordKnownLocation("docker", d.ref.Hostname(), digest, fmt.Sprintf(blobsURL, d.ref.RemoteName(), digest))
+				}
+				return digest, size, err
+			}
+		}
+	}
+
+	location, err := d.startUpload()
+	if err != nil {
+		return "", -1, err
+	}
+
+	h := sha256.New()
+	tee := io.TeeReader(stream, h)
+	var offset int64
+	buf := make([]byte, d.effectiveChunkSize())
+	for {
+		n, readErr := io.ReadFull(tee, buf)
+		if n > 0 {
+			newLocation, newOffset, err := d.uploadChunkResumable(location, buf[:n], offset)
+			if err != nil {
+				return "", -1, err
+			}
+			location = newLocation
+			offset = newOffset
+		}
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			break
+		}
+		if readErr != nil {
+			return "", -1, readErr
+		}
+	}
+
+	computedDigest := "sha256:" + hex.EncodeToString(h.Sum(nil))
+	if err := d.finishUpload(location, computedDigest); err != nil {
+		return "", -1, err
+	}
+	if options.Cache != nil {
+		options.Cache.RecordKnownLocation("docker", d.ref.Hostname(), computedDigest, fmt.Sprintf(blobsURL, d.ref.RemoteName(), computedDigest))
+	}
+	return computedDigest, offset, nil
+}
+
+// uploadChunkResumable PATCHes chunk at offset, and if that fails with a retriable network error,
+// re-GETs location to find out how many of chunk's bytes the registry actually received, then
+// re-sends only the unconfirmed suffix, instead of re-sending bytes the registry already has (which
+// would make it, and the digest being computed over the original stream, disagree about the
+// blob's contents) or silently skipping bytes it does not have. It returns the Location to use for
+// the next chunk and the stream offset the upload has reached.
+func (d *dockerImageDestination) uploadChunkResumable(location string, chunk []byte, offset int64) (string, int64, error) {
+	for {
+		newLocation, patchErr := d.uploadChunk(location, chunk, offset)
+		if patchErr == nil {
+			return newLocation, offset + int64(len(chunk)), nil
+		}
+		if !isRetriableNetError(patchErr) {
+			return "", 0, patchErr
+		}
+		resumed, resumeErr := d.resumeOffset(location)
+		if resumeErr != nil {
+			return "", 0, fmt.Errorf("Error resuming upload after network error: %v (original error: %v)", resumeErr, patchErr)
+		}
+		switch {
+		case resumed >= offset+int64(len(chunk)):
+			// The registry actually received the whole chunk despite the error on our end.
+			return location, offset + int64(len(chunk)), nil
+		case resumed > offset:
+			chunk = chunk[resumed-offset:]
+			offset = resumed
+		case resumed < offset:
+			return "", 0, fmt.Errorf("registry reported upload offset %d going backwards from %d", resumed, offset)
+		}
+	}
+}
+
+// HasBlob returns true and the blob's size if a blob matching digest is already present in this
+// repository, without uploading anything.
+func (d *dockerImageDestination) HasBlob(digest string) (bool, int64, error) {
+	url := fmt.Sprintf(blobsURL, d.ref.RemoteName(), digest)
+	res, err := d.c.makeRequest("HEAD", url, nil, nil)
+	if err != nil {
+		return false, -1, err
+	}
+	defer res.Body.Close()
+	switch res.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return false, -1, nil
+	default:
+		return false, -1, fmt.Errorf("Invalid status code returned when checking for blob %d", res.StatusCode)
+	}
+	size, err := strconv.ParseInt(res.Header.Get("Content-Length"), 10, 64)
+	if err != nil {
+		size = -1
+	}
+	return true, size, nil
+}
+
+// otherRepoWithBlob looks through cache for a repository on this registry, other than d's own,
+// that is known to already have digest, returning its name and true if one is found.
+func (d *dockerImageDestination) otherRepoWithBlob(digest string, cache blobinfocache.BlobInfoCache) (string, bool) {
+	if cache == nil {
+		return "", false
+	}
+	for _, location := range cache.CandidateLocations("docker", d.ref.Hostname(), digest) {
+		if repo, ok := repoNameFromBlobLocation(location); ok && repo != d.ref.RemoteName() {
+			return repo, true
+		}
+	}
+	return "", false
+}
+
+// repoNameFromBlobLocation extracts the repository name from a location recorded by PutBlob,
+// i.e. the %s blobsURL was formatted with.
+func repoNameFromBlobLocation(location string) (string, bool) {
+	const prefix = "/v2/"
+	const infix = "/blobs/"
+	if !strings.HasPrefix(location, prefix) {
+		return "", false
+	}
+	rest := location[len(prefix):]
+	i := strings.Index(rest, infix)
+	if i <= 0 {
+		return "", false
+	}
+	return rest[:i], true
+}
+
+// tryCrossRepoMount attempts to have the registry mount an existing blob with this digest from
+// fromRepo, a different repository on the same registry we have access to, instead of re-uploading
+// it. It returns true if the mount succeeded.
+func (d *dockerImageDestination) tryCrossRepoMount(digest, fromRepo string) (bool, error) {
+	url := fmt.Sprintf(blobUploadURL, d.ref.RemoteName()) + fmt.Sprintf("?mount=%s&from=%s", digest, fromRepo)
+	res, err := d.c.makeRequest("POST", url, nil, nil)
+	if err != nil {
+		return false, err
+	}
+	defer res.Body.Close()
+	return res.StatusCode == http.StatusCreated, nil
+}
+
+// startUpload begins a new chunked upload session and returns the Location URL to PATCH to.
+func (d *dockerImageDestination) startUpload() (string, error) {
+	url := fmt.Sprintf(blobUploadURL, d.ref.RemoteName())
+	res, err := d.c.makeRequest("POST", url, nil, nil)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusAccepted {
+		return "", fmt.Errorf("Error starting layer upload, status %d", res.StatusCode)
+	}
+	location := res.Header.Get("Location")
+	if location == "" {
+		return "", fmt.Errorf("registry did not return a Location header for the new upload")
+	}
+	return location, nil
+}
+
+// uploadChunk PATCHes a single chunk at the given offset and returns the Location to use for the
+// next chunk (the registry is allowed to change it on every response).
+func (d *dockerImageDestination) uploadChunk(location string, chunk []byte, offset int64) (string, error) {
+	headers := map[string][]string{
+		"Content-Range": {fmt.Sprintf("%d-%d", offset, offset+int64(len(chunk))-1)},
+		"Content-Type":  {"application/octet-stream"},
+	}
+	res, err := d.c.makeRequest("PATCH", location, headers, bytes.NewReader(chunk))
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusAccepted {
+		return "", fmt.Errorf("Error uploading chunk at offset %d, status %d", offset, res.StatusCode)
+	}
+	newLocation := res.Header.Get("Location")
+	if newLocation == "" {
+		newLocation = location
+	}
+	return newLocation, nil
+}
+
+// resumeOffset re-GETs location after a failed PATCH to ask the registry how many bytes of the
+// upload it actually has, so the caller can resume instead of restarting from zero.
+func (d *dockerImageDestination) resumeOffset(location string) (int64, error) {
+	res, err := d.c.makeRequest("GET", location, nil, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusNoContent {
+		return 0, fmt.Errorf("Error querying upload status, status %d", res.StatusCode)
+	}
+	rangeHeader := res.Header.Get("Range")
+	if rangeHeader == "" {
+		return 0, nil
+	}
+	var start, end int64
+	if _, err := fmt.Sscanf(rangeHeader, "%d-%d", &start, &end); err != nil {
+		return 0, fmt.Errorf("Error parsing Range header %q: %v", rangeHeader, err)
+	}
+	return end + 1, nil
+}
+
+// finishUpload completes the upload session with the final, now-known blob digest.
+func (d *dockerImageDestination) finishUpload(location, digest string) error {
+	url := location
+	if containsQuery(url) {
+		url += "&digest=" + digest
+	} else {
+		url += "?digest=" + digest
+	}
+	res, err := d.c.makeRequest("PUT", url, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusCreated {
+		return fmt.Errorf("Error completing layer upload, status %d", res.StatusCode)
+	}
+	return nil
+}
+
+// blobSize HEADs digest to find its size after a successful cross-repo mount.
+func (d *dockerImageDestination) blobSize(digest string) (int64, error) {
+	url := fmt.Sprintf(blobsURL, d.ref.RemoteName(), digest)
+	res, err := d.c.makeRequest("HEAD", url, nil, nil)
+	if err != nil {
+		return -1, err
+	}
+	defer res.Body.Close()
+	size, err := strconv.ParseInt(res.Header.Get("Content-Length"), 10, 64)
+	if err != nil {
+		return -1, nil
+	}
+	return size, nil
+}
+
+func (d *dockerImageDestination) effectiveChunkSize() int64 {
+	if d.chunkSize <= 0 {
+		return defaultChunkSize
+	}
+	return d.chunkSize
+}
+
+// PutSignatures pushes signatures to the sigstore lookaside location configured for this
+// registry in /etc/containers/registries.d, against the digest of the most recently pushed
+// manifest (PutManifest must be called before PutSignatures). If no lookaside is configured for
+// this registry, non-empty signatures are rejected rather than silently dropped.
+func (d *dockerImageDestination) PutSignatures(signatures [][]byte) error {
+	if len(signatures) == 0 {
+		return nil
+	}
+	if d.manifestDigest == "" {
+		return fmt.Errorf("PutSignatures called before PutManifest; no manifest digest to attach signatures to")
+	}
+	base, err := sigstoreBaseURL(d.ref.Hostname())
+	if err != nil {
+		return err
+	}
+	if base == "" {
+		return fmt.Errorf("Pushing signatures for %s is not supported: no sigstore configured in %s", d.ref.Hostname(), registriesDPath)
+	}
+	return putLookasideSignatures(base, d.ref.RemoteName(), d.manifestDigest, signatures)
+}
+
+func isRetriableNetError(err error) bool {
+	_, ok := err.(net.Error)
+	return ok
+}
+
+func containsQuery(url string) bool {
+	for _, c := range url {
+		if c == '?' {
+			return true
+		}
+	}
+	return false
+}
@@ -9,6 +9,7 @@ import (
 
 	"github.com/Sirupsen/logrus"
 	"github.com/containers/image/manifest"
+	"github.com/containers/image/pkg/encryption"
 	"github.com/containers/image/reference"
 	"github.com/containers/image/types"
 )
@@ -57,6 +58,10 @@ func (s *dockerImageSource) IntendedDockerReference() string {
 	return fmt.Sprintf("%s:%s", s.ref.Name(), s.tag)
 }
 
+// GetManifest fetches the manifest for s's tag, requesting mimetypes (as the Accept header,
+// verbatim) from the registry. It does not add manifest.DockerV2ListMIMEType or
+// imgspecv1.MediaTypeImageManifestList on its own: a caller that wants a manifest list back must
+// ask for one explicitly.
 func (s *dockerImageSource) GetManifest(mimetypes []string) ([]byte, string, error) {
 	url := fmt.Sprintf(manifestURL, s.ref.RemoteName(), s.tag)
 	// TODO(runcom) set manifest version header! schema1 for now - then schema2 etc etc and v1
@@ -94,11 +99,82 @@ func (s *dockerImageSource) GetBlob(digest string) (io.ReadCloser, int64, error)
 	if err != nil {
 		size = 0
 	}
+
 	return res.Body, size, nil
 }
 
+// DecryptBlob transparently decrypts an encrypted layer returned by GetBlob, given the layer
+// descriptor's encryption annotations (see pkg/encryption) and a DecryptConfig holding a matching
+// private key; it mirrors the encryption oci.ociImageDestination.PutBlob applies on the way in.
+func (s *dockerImageSource) DecryptBlob(blob io.ReadCloser, annotations map[string]string, config encryption.DecryptConfig) (io.ReadCloser, error) {
+	return encryption.Decrypt(blob, annotations, config)
+}
+
+// HasBlob returns true and the blob's size if a blob matching digest is already present in the
+// repository this source was constructed for, by issuing a HEAD request instead of downloading it.
+// This lets a copy operation backed by a blobinfocache.BlobInfoCache skip re-uploading a layer that
+// a previous copy already pushed to the same repository.
+func (s *dockerImageSource) HasBlob(digest string) (bool, int64, error) {
+	url := fmt.Sprintf(blobsURL, s.ref.RemoteName(), digest)
+	res, err := s.c.makeRequest("HEAD", url, nil, nil)
+	if err != nil {
+		return false, -1, err
+	}
+	defer res.Body.Close()
+	switch res.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return false, -1, nil
+	default:
+		return false, -1, fmt.Errorf("Invalid status code returned when checking for blob %d", res.StatusCode)
+	}
+	size, err := strconv.ParseInt(res.Header.Get("Content-Length"), 10, 64)
+	if err != nil {
+		size = -1
+	}
+	return true, size, nil
+}
+
+// GetSignatures fetches detached signatures from the sigstore lookaside location configured for
+// this registry in /etc/containers/registries.d, if any. Registries with no configured lookaside
+// are assumed to carry no signatures, rather than treated as an error.
 func (s *dockerImageSource) GetSignatures() ([][]byte, error) {
-	return [][]byte{}, nil
+	base, err := sigstoreBaseURL(s.ref.Hostname())
+	if err != nil {
+		return nil, err
+	}
+	if base == "" {
+		return [][]byte{}, nil
+	}
+
+	digest, err := s.manifestDigest()
+	if err != nil {
+		return nil, err
+	}
+	return getLookasideSignatures(base, s.ref.RemoteName(), digest)
+}
+
+// manifestDigest returns the Docker-Content-Digest of the image's current manifest, as reported
+// by the registry, without downloading the whole manifest body again if avoidable.
+func (s *dockerImageSource) manifestDigest() (string, error) {
+	headers := map[string][]string{"Accept": {manifest.DockerV2Schema2MIMEType}}
+	url := fmt.Sprintf(manifestURL, s.ref.RemoteName(), s.tag)
+	res, err := s.c.makeRequest("GET", url, headers, nil)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Invalid status code returned when fetching manifest digest %d", res.StatusCode)
+	}
+	if digest := res.Header.Get("Docker-Content-Digest"); digest != "" {
+		return digest, nil
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return "", err
+	}
+	return manifest.Digest(body)
 }
 
 func (s *dockerImageSource) Delete() error {
@@ -0,0 +1,104 @@
+package docker
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+
+	"gopkg.in/yaml.v2"
+)
+
+// registriesDPath is where the sigstore lookaside configuration lives, mapping registries to the
+// HTTP(S) location their signatures are published at.
+const registriesDPath = "/etc/containers/registries.d/default.yaml"
+
+// registriesDConfig is the (relevant subset of the) registries.d YAML format.
+type registriesDConfig struct {
+	Docker        map[string]registrySigstoreConfig `yaml:"docker"`
+	DefaultDocker *registrySigstoreConfig            `yaml:"default-docker"`
+}
+
+type registrySigstoreConfig struct {
+	SigStore string `yaml:"sigstore"`
+}
+
+// sigstoreBaseURL returns the base lookaside URL configured for hostname, or "" if none is
+// configured (in which case signature push/pull against this registry is simply skipped).
+func sigstoreBaseURL(hostname string) (string, error) {
+	data, err := ioutil.ReadFile(registriesDPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", err
+	}
+	var config registriesDConfig
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return "", fmt.Errorf("Error parsing %s: %v", registriesDPath, err)
+	}
+	if perRegistry, ok := config.Docker[hostname]; ok && perRegistry.SigStore != "" {
+		return perRegistry.SigStore, nil
+	}
+	if config.DefaultDocker != nil {
+		return config.DefaultDocker.SigStore, nil
+	}
+	return "", nil
+}
+
+// sigstoreSignatureURL builds the lookaside URL for the i'th (1-based, matching the dir transport's
+// "signature-N" naming) signature of repo@digest.
+func sigstoreSignatureURL(base, repo, digest string, i int) string {
+	return fmt.Sprintf("%s/%s@%s/signature-%d", base, repo, digest, i)
+}
+
+// getLookasideSignatures fetches every signature-N that exists at base for repo@digest, stopping
+// at the first N that 404s (the convention, matching the dir transport's signature-N numbering,
+// has no separate index of how many there are).
+func getLookasideSignatures(base, repo, digest string) ([][]byte, error) {
+	var signatures [][]byte
+	for i := 1; ; i++ {
+		res, err := http.Get(sigstoreSignatureURL(base, repo, digest, i))
+		if err != nil {
+			return nil, err
+		}
+		if res.StatusCode == http.StatusNotFound {
+			res.Body.Close()
+			break
+		}
+		if res.StatusCode != http.StatusOK {
+			res.Body.Close()
+			return nil, fmt.Errorf("Error fetching signature %d for %s@%s, status %d", i, repo, digest, res.StatusCode)
+		}
+		data, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		signatures = append(signatures, data)
+	}
+	return signatures, nil
+}
+
+// putLookasideSignatures PUTs signatures to base, numbered signature-1, signature-2, ... for
+// repo@digest, matching the numbering getLookasideSignatures and the dir transport both use.
+func putLookasideSignatures(base, repo, digest string, signatures [][]byte) error {
+	client := &http.Client{}
+	for i, sig := range signatures {
+		url := sigstoreSignatureURL(base, repo, digest, i+1)
+		req, err := http.NewRequest("PUT", url, bytes.NewReader(sig))
+		if err != nil {
+			return err
+		}
+		res, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusCreated {
+			return fmt.Errorf("Error pushing signature %d for %s@%s, status %d", i+1, repo, digest, res.StatusCode)
+		}
+	}
+	return nil
+}
@@ -11,6 +11,8 @@ import (
 	"path/filepath"
 
 	"github.com/containers/image/manifest"
+	"github.com/containers/image/pkg/compression"
+	"github.com/containers/image/pkg/encryption"
 	"github.com/containers/image/types"
 	imgspec "github.com/opencontainers/image-spec/specs-go"
 	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
@@ -18,11 +20,15 @@ import (
 
 type ociImageDestination struct {
 	ref ociReference
+	// encryptedLayers maps the digest PutBlob returned for an encrypted layer to the descriptor
+	// annotations Encrypt produced for it, so createManifest can find and rewrite that layer's
+	// MediaType to its EncryptedMediaType when the manifest referencing it comes through PutManifest.
+	encryptedLayers map[string]map[string]string
 }
 
 // newImageDestination returns an ImageDestination for writing to an existing directory.
 func newImageDestination(ref ociReference) types.ImageDestination {
-	return &ociImageDestination{ref: ref}
+	return &ociImageDestination{ref: ref, encryptedLayers: map[string]map[string]string{}}
 }
 
 // Reference returns the reference used to set up this destination.  Note that this should directly correspond to user's intent,
@@ -31,7 +37,13 @@ func (d *ociImageDestination) Reference() types.ImageReference {
 	return d.ref
 }
 
-func createManifest(m []byte) ([]byte, string, error) {
+// EncryptedMediaType returns the "+encrypted" variant of a layer media type, e.g.
+// "application/vnd.oci.image.layer.v1.tar+gzip" becomes "...+gzip+encrypted".
+func EncryptedMediaType(mt string) string {
+	return mt + encryption.MediaTypeSuffix
+}
+
+func (d *ociImageDestination) createManifest(m []byte) ([]byte, string, error) {
 	om := imgspecv1.Manifest{}
 	mt := manifest.GuessMIMEType(m)
 	switch mt {
@@ -48,6 +60,18 @@ func createManifest(m []byte) ([]byte, string, error) {
 		om.MediaType = imgspecv1.MediaTypeImageManifest
 		for i := range om.Layers {
 			om.Layers[i].MediaType = imgspecv1.MediaTypeImageSerialization
+			// If PutBlob encrypted this layer (options.Encrypt was set), rewrite its MediaType to
+			// the "+encrypted" variant and attach the annotations Encrypt produced, so a reader
+			// knows to run it through Decrypt before treating it as a plain layer.
+			if annotations, ok := d.encryptedLayers[om.Layers[i].Digest]; ok {
+				om.Layers[i].MediaType = EncryptedMediaType(om.Layers[i].MediaType)
+				if om.Layers[i].Annotations == nil {
+					om.Layers[i].Annotations = map[string]string{}
+				}
+				for k, v := range annotations {
+					om.Layers[i].Annotations[k] = v
+				}
+			}
 		}
 		om.Config.MediaType = imgspecv1.MediaTypeImageSerializationConfig
 		b, err := json.Marshal(om)
@@ -56,9 +80,17 @@ func createManifest(m []byte) ([]byte, string, error) {
 		}
 		return b, om.MediaType, nil
 	case manifest.DockerV2ListMIMEType:
-		return nil, "", fmt.Errorf("can't create OCI manifest from Docker V2 schema 2 manifest list")
+		// Each entry in a Docker manifest list is translated by createManifest into a new OCI
+		// manifest with a new digest, so a converted index can only point at the right digests if
+		// the per-platform manifests were pushed (and thereby converted) through PutManifest
+		// first; PutManifest only sees m's bytes, not the other manifests a list references, so it
+		// cannot do that itself. Push each platform's manifest first, then an OCI image index (see
+		// the imgspecv1.MediaTypeImageManifestList case) that already references the resulting
+		// digests, the same way a multi-platform copy pushes a native OCI index.
+		return nil, "", fmt.Errorf("converting a Docker manifest list requires its per-platform manifests to be pushed first; push an OCI image index referencing them instead")
 	case imgspecv1.MediaTypeImageManifestList:
-		return nil, "", fmt.Errorf("can't create OCI manifest from OCI manifest list")
+		// Already an OCI index; nothing to translate.
+		return m, mt, nil
 	case imgspecv1.MediaTypeImageManifest:
 		return m, mt, nil
 	}
@@ -68,7 +100,7 @@ func createManifest(m []byte) ([]byte, string, error) {
 func (d *ociImageDestination) PutManifest(m []byte) error {
 	// TODO(mitr, runcom): this breaks signatures entirely since at this point we're creating a new manifest
 	// and signatures don't apply anymore. Will fix.
-	ociMan, mt, err := createManifest(m)
+	ociMan, mt, err := d.createManifest(m)
 	if err != nil {
 		return err
 	}
@@ -78,7 +110,8 @@ func (d *ociImageDestination) PutManifest(m []byte) error {
 	}
 	desc := imgspec.Descriptor{}
 	desc.Digest = digest
-	// TODO(runcom): beaware and add support for OCI manifest list
+	// mt may be imgspecv1.MediaTypeImageManifestList when m was an OCI image index (Docker manifest
+	// lists are rejected by createManifest); the descriptor and blob layout below work the same either way.
 	desc.MediaType = mt
 	desc.Size = int64(len(ociMan))
 	data, err := json.Marshal(desc)
@@ -106,11 +139,19 @@ func (d *ociImageDestination) PutManifest(m []byte) error {
 
 // PutBlob writes contents of stream and returns its computed digest and size (both if can be computed).
 // A digest can be optionally provided if known, the specific image destination can decide to play with it or not.
+// If options.DesiredCompression is not compression.Uncompressed and differs from the compression stream is
+// actually using, PutBlob transcodes the blob on the fly, streaming decompression straight into recompression
+// through an io.Pipe so the whole layer never sits in memory; the returned digest is always of the bytes
+// actually written to storage. If options.DiffID is not nil, it receives the digest of stream's
+// decompressed contents, computed alongside the write without buffering the layer a second time.
+// If options.Encrypt is set, the blob is additionally encrypted for options.Encrypt.Recipients and the
+// resulting descriptor annotations are written into *options.EncryptAnnotations; PutBlob fails, rather
+// than writing out plaintext, if encryption was requested but could not be performed.
 // WARNING: The contents of stream are being verified on the fly.  Until stream.Read() returns io.EOF, the contents of the data SHOULD NOT be available
 // to any other readers for download using the supplied digest.
 // If stream.Read() at any time, ESPECIALLY at end of input, returns an error, PutBlob MUST 1) fail, and 2) delete any data stored so far.
 // Note: Calling PutBlob() and other methods may have ordering dependencies WRT other methods of this type. FIXME: Figure out and document.
-func (d *ociImageDestination) PutBlob(stream io.Reader, _ string) (string, int64, error) {
+func (d *ociImageDestination) PutBlob(stream io.Reader, _ string, options types.PutBlobOptions) (string, int64, error) {
 	blobFile, err := ioutil.TempFile(d.ref.dir, "oci-put-blob")
 	if err != nil {
 		return "", -1, err
@@ -123,11 +164,75 @@ func (d *ociImageDestination) PutBlob(stream io.Reader, _ string) (string, int64
 		}
 	}()
 
+	srcCompression, detected, err := compression.DetectCompression(stream)
+	if err != nil {
+		return "", -1, fmt.Errorf("Error detecting compression of blob: %v", err)
+	}
+
+	src := detected
+	var diffIDResult func() (string, error)
+	var abortDiffID func()
+	if options.DesiredCompression != compression.Uncompressed && options.DesiredCompression != srcCompression {
+		dec, err := compression.NewDecompressor(srcCompression, detected)
+		if err != nil {
+			return "", -1, fmt.Errorf("Error decompressing blob: %v", err)
+		}
+		defer dec.Close()
+
+		diffIDHash := sha256.New()
+		pr, pw := io.Pipe()
+		enc, err := compression.NewCompressor(options.DesiredCompression, pw)
+		if err != nil {
+			return "", -1, fmt.Errorf("Error recompressing blob to %s: %v", options.DesiredCompression, err)
+		}
+		go func() {
+			_, copyErr := io.Copy(enc, io.TeeReader(dec, diffIDHash))
+			closeErr := enc.Close()
+			if copyErr != nil {
+				pw.CloseWithError(copyErr)
+				return
+			}
+			pw.CloseWithError(closeErr)
+		}()
+		src = pr
+		diffIDResult = func() (string, error) { return "sha256:" + hex.EncodeToString(diffIDHash.Sum(nil)), nil }
+		// If the caller downstream of src (pr) stops reading before EOF, the goroutine above is
+		// left blocked writing into pw forever; unblock it by forcing its writes to fail.
+		abortDiffID = func() { pw.CloseWithError(fmt.Errorf("PutBlob: aborting recompression after a downstream error")) }
+	} else if srcCompression != compression.Uncompressed && options.DiffID != nil {
+		src, diffIDResult, abortDiffID = startDiffIDComputation(detected, srcCompression)
+	} else if options.DiffID != nil {
+		// Already uncompressed: its DiffID is just its own digest, computed as src is read below;
+		// the hash is taken here, before any encryption, so it covers the plaintext.
+		diffIDHash := sha256.New()
+		tee := io.TeeReader(detected, diffIDHash)
+		src = tee
+		diffIDResult = func() (string, error) { return "sha256:" + hex.EncodeToString(diffIDHash.Sum(nil)), nil }
+	}
+
+	var encryptAnnotations map[string]string
+	if options.Encrypt != nil {
+		encrypted, annotations, err := encryption.Encrypt(src, *options.Encrypt)
+		if err != nil {
+			// Refuse to persist a plaintext layer when encryption was requested.
+			return "", -1, fmt.Errorf("Error encrypting blob: %v", err)
+		}
+		defer encrypted.Close()
+		if options.EncryptAnnotations != nil {
+			*options.EncryptAnnotations = annotations
+		}
+		encryptAnnotations = annotations
+		src = encrypted
+	}
+
 	h := sha256.New()
-	tee := io.TeeReader(stream, h)
+	tee := io.TeeReader(src, h)
 
 	size, err := io.Copy(blobFile, tee)
 	if err != nil {
+		if abortDiffID != nil {
+			abortDiffID()
+		}
 		return "", -1, err
 	}
 	if err := blobFile.Sync(); err != nil {
@@ -136,6 +241,17 @@ func (d *ociImageDestination) PutBlob(stream io.Reader, _ string) (string, int64
 	if err := blobFile.Chmod(0644); err != nil {
 		return "", -1, err
 	}
+	if diffIDResult != nil {
+		// The caller has now fully drained tee, so the background goroutine computing the DiffID
+		// has seen all the bytes it needs and this won't block.
+		diffID, err := diffIDResult()
+		if err != nil {
+			return "", -1, fmt.Errorf("Error computing DiffID of blob: %v", err)
+		}
+		if options.DiffID != nil {
+			*options.DiffID = diffID
+		}
+	}
 
 	computedDigest := "sha256:" + hex.EncodeToString(h.Sum(nil))
 	blobPath, err := d.ref.blobPath(computedDigest)
@@ -149,9 +265,65 @@ func (d *ociImageDestination) PutBlob(stream io.Reader, _ string) (string, int64
 		return "", -1, err
 	}
 	succeeded = true
+	if options.Cache != nil {
+		options.Cache.RecordKnownLocation("oci", d.ref.dir, computedDigest, blobPath)
+	}
+	if encryptAnnotations != nil {
+		d.encryptedLayers[computedDigest] = encryptAnnotations
+	}
 	return computedDigest, size, nil
 }
 
+// HasBlob returns true and the blob's size if a blob matching digest is already present in the
+// destination's underlying storage, so callers can avoid re-streaming a layer they already pushed.
+func (d *ociImageDestination) HasBlob(digest string) (bool, int64, error) {
+	blobPath, err := d.ref.blobPath(digest)
+	if err != nil {
+		return false, -1, err
+	}
+	fi, err := os.Stat(blobPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, -1, nil
+		}
+		return false, -1, err
+	}
+	return true, fi.Size(), nil
+}
+
+// startDiffIDComputation returns a reader which yields exactly the same bytes as compressedSrc (still compressed
+// with algo) while, in the background, computing the sha256 digest of its decompressed contents. The result
+// function must only be called after the returned reader has been fully drained by the caller; it then blocks
+// until the background decompression has caught up and returns the resulting DiffID. If the caller instead
+// abandons the reader before EOF (e.g. because writing it out failed), it must call the abort function instead,
+// or the background goroutine is left blocked forever waiting for bytes that will never come.
+func startDiffIDComputation(compressedSrc io.Reader, algo compression.Algorithm) (io.Reader, func() (string, error), func()) {
+	pr, pw := io.Pipe()
+	tee := io.TeeReader(compressedSrc, pw)
+	h := sha256.New()
+	done := make(chan error, 1)
+	go func() {
+		dec, err := compression.NewDecompressor(algo, pr)
+		if err != nil {
+			pr.CloseWithError(err)
+			done <- err
+			return
+		}
+		_, err = io.Copy(h, dec)
+		dec.Close()
+		done <- err
+	}()
+	result := func() (string, error) {
+		pw.Close()
+		if err := <-done; err != nil {
+			return "", err
+		}
+		return "sha256:" + hex.EncodeToString(h.Sum(nil)), nil
+	}
+	abort := func() { pw.CloseWithError(fmt.Errorf("DiffID computation aborted after a downstream error")) }
+	return tee, result, abort
+}
+
 // ensureParentDirectoryExists ensures the parent of the supplied path exists.
 func ensureParentDirectoryExists(path string) error {
 	parent := filepath.Dir(path)
@@ -166,13 +338,39 @@ func ensureParentDirectoryExists(path string) error {
 func (d *ociImageDestination) SupportedManifestMIMETypes() []string {
 	return []string{
 		imgspecv1.MediaTypeImageManifest,
+		imgspecv1.MediaTypeImageManifestList,
 		manifest.DockerV2Schema2MIMEType,
 	}
 }
 
+// PutSignatures writes each signature as its own content-addressed blob under the OCI layout's
+// blobs directory (so they benefit from the same digest-based storage as manifests and layers),
+// and records their digests in a "signatures-<tag>" side file next to the image's descriptor.
+// This is an OCI-layout-specific extension: the image-spec has no manifest field of its own that
+// references signature blobs, so they can't (yet) be reached by walking the index/manifest alone.
 func (d *ociImageDestination) PutSignatures(signatures [][]byte) error {
-	if len(signatures) != 0 {
-		return fmt.Errorf("Pushing signatures for OCI images is not supported")
+	digests := make([]string, 0, len(signatures))
+	for _, sig := range signatures {
+		digest, err := manifest.Digest(sig)
+		if err != nil {
+			return err
+		}
+		blobPath, err := d.ref.blobPath(digest)
+		if err != nil {
+			return err
+		}
+		if err := ensureParentDirectoryExists(blobPath); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(blobPath, sig, 0644); err != nil {
+			return err
+		}
+		digests = append(digests, digest)
 	}
-	return nil
+
+	data, err := json.Marshal(digests)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(d.ref.signaturesPath(d.ref.tag), data, 0644)
 }
@@ -0,0 +1,188 @@
+// Package blobinfocache implements a cache of knowledge about blobs that have already been seen
+// somewhere, so that copy operations can avoid re-uploading or re-downloading layers that a
+// destination is known to already have.
+package blobinfocache
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+)
+
+// BlobInfoCache records data about blobs seen across copy operations: the correspondence between
+// a (possibly compressed) blob digest and the digest of its uncompressed contents (the layer
+// DiffID), and the set of locations (within a given transport and scope, e.g. a registry
+// repository or a directory path) where a blob with a given digest is already known to exist.
+//
+// Implementations must be safe for concurrent use.
+type BlobInfoCache interface {
+	// UncompressedDigest returns the digest of the uncompressed contents of the blob with digest
+	// anyDigest, if known, or "" otherwise. anyDigest may itself already be an uncompressed digest.
+	UncompressedDigest(anyDigest string) string
+	// RecordDigestUncompressedPair records that the blob with digest anyDigest has uncompressed
+	// contents with digest uncompressed. It's allowed for anyDigest == uncompressed.
+	RecordDigestUncompressedPair(anyDigest, uncompressed string)
+	// RecordKnownLocation records that a blob with digest is known to exist within scope,
+	// identified by location (e.g. a registry blob URL, or a path on disk).
+	RecordKnownLocation(transport, scope, digest, location string)
+	// CandidateLocations returns the locations within scope where a blob with digest is known to
+	// already exist, most-recently-recorded first, so a caller can HEAD/os.Stat them instead of
+	// re-uploading or re-downloading the blob.
+	CandidateLocations(transport, scope, digest string) []string
+}
+
+// persistedState is the on-disk representation of a fileCache.
+type persistedState struct {
+	// UncompressedDigests maps any digest (compressed or not) to the digest of its uncompressed contents.
+	UncompressedDigests map[string]string `json:"uncompressedDigests"`
+	// Locations maps "transport:scope:digest" to the list of known locations, most recent last.
+	Locations map[string][]string `json:"locations"`
+}
+
+// fileCache is a BlobInfoCache implementation that persists to a single JSON file. A load-modify-save
+// cycle holds both an in-process mutex (serializing goroutines within this process) and a POSIX
+// file lock on path+".lock" (serializing separate processes sharing the same cache file), so it is
+// safe for concurrent use across processes, not just within one.
+type fileCache struct {
+	mutex sync.Mutex
+	path  string
+}
+
+// lockAndDo takes mutex and an exclusive, blocking flock on c.path+".lock", then calls fn; the lock
+// file is created if it does not already exist. The file lock is what makes the load-modify-save
+// cycle below safe across processes; the mutex alone would only protect this process's goroutines.
+func (c *fileCache) lockAndDo(fn func() error) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	lockFile, err := os.OpenFile(c.path+".lock", os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	defer lockFile.Close()
+	if err := syscall.Flock(int(lockFile.Fd()), syscall.LOCK_EX); err != nil {
+		return err
+	}
+	defer syscall.Flock(int(lockFile.Fd()), syscall.LOCK_UN)
+
+	return fn()
+}
+
+// DefaultCache returns a BlobInfoCache persisted under $XDG_CACHE_HOME/containers (or
+// ~/.cache/containers if unset), creating the directory if necessary.
+func DefaultCache() (BlobInfoCache, error) {
+	dir, err := defaultCacheDir()
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &fileCache{path: filepath.Join(dir, "blob-info-cache.json")}, nil
+}
+
+func defaultCacheDir() (string, error) {
+	if xdg := os.Getenv("XDG_CACHE_HOME"); xdg != "" {
+		return filepath.Join(xdg, "containers"), nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".cache", "containers"), nil
+}
+
+func (c *fileCache) load() (*persistedState, error) {
+	state := &persistedState{
+		UncompressedDigests: map[string]string{},
+		Locations:           map[string][]string{},
+	}
+	data, err := ioutil.ReadFile(c.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return state, nil
+		}
+		return nil, err
+	}
+	if len(data) == 0 {
+		return state, nil
+	}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+func (c *fileCache) save(state *persistedState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(c.path, data, 0600)
+}
+
+func (c *fileCache) UncompressedDigest(anyDigest string) string {
+	var result string
+	_ = c.lockAndDo(func() error {
+		state, err := c.load()
+		if err != nil {
+			return err
+		}
+		result = state.UncompressedDigests[anyDigest]
+		return nil
+	})
+	return result
+}
+
+func (c *fileCache) RecordDigestUncompressedPair(anyDigest, uncompressed string) {
+	_ = c.lockAndDo(func() error {
+		state, err := c.load()
+		if err != nil {
+			return err
+		}
+		state.UncompressedDigests[anyDigest] = uncompressed
+		return c.save(state)
+	})
+}
+
+func locationsKey(transport, scope, digest string) string {
+	return transport + ":" + scope + ":" + digest
+}
+
+func (c *fileCache) RecordKnownLocation(transport, scope, digest, location string) {
+	_ = c.lockAndDo(func() error {
+		state, err := c.load()
+		if err != nil {
+			return err
+		}
+		key := locationsKey(transport, scope, digest)
+		for _, l := range state.Locations[key] {
+			if l == location {
+				return nil // already recorded
+			}
+		}
+		state.Locations[key] = append(state.Locations[key], location)
+		return c.save(state)
+	})
+}
+
+func (c *fileCache) CandidateLocations(transport, scope, digest string) []string {
+	var reversed []string
+	_ = c.lockAndDo(func() error {
+		state, err := c.load()
+		if err != nil {
+			return err
+		}
+		locations := state.Locations[locationsKey(transport, scope, digest)]
+		// Most-recently-recorded first.
+		reversed = make([]string, len(locations))
+		for i, l := range locations {
+			reversed[len(locations)-1-i] = l
+		}
+		return nil
+	})
+	return reversed
+}
@@ -0,0 +1,92 @@
+// Package compression provides helpers for detecting and converting between the
+// compression formats used for layer blobs (gzip, zstd, or plain uncompressed tar).
+package compression
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Algorithm is a compression algorithm that can be applied to a blob stream.
+type Algorithm string
+
+const (
+	// Uncompressed means the stream carries no compression at all.
+	Uncompressed Algorithm = ""
+	// Gzip is the traditional Docker v2s2 layer compression.
+	Gzip Algorithm = "gzip"
+	// Zstd is a faster, better-compressing alternative supported by OCI.
+	Zstd Algorithm = "zstd"
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// DetectCompression peeks at the first bytes of input to determine which Algorithm, if
+// any, it is compressed with, and returns a reader that reproduces the full original
+// stream (including the bytes consumed for detection).
+func DetectCompression(input io.Reader) (Algorithm, io.Reader, error) {
+	buf := make([]byte, 4)
+	n, err := io.ReadFull(input, buf)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return Uncompressed, nil, err
+	}
+	buf = buf[:n]
+	stream := io.MultiReader(bytes.NewReader(buf), input)
+
+	switch {
+	case bytes.HasPrefix(buf, gzipMagic):
+		return Gzip, stream, nil
+	case bytes.HasPrefix(buf, zstdMagic):
+		return Zstd, stream, nil
+	default:
+		return Uncompressed, stream, nil
+	}
+}
+
+// NewDecompressor returns a reader yielding the uncompressed contents of input, which is
+// already known to be compressed with algo.
+func NewDecompressor(algo Algorithm, input io.Reader) (io.ReadCloser, error) {
+	switch algo {
+	case Gzip:
+		return gzip.NewReader(input)
+	case Zstd:
+		dec, err := zstd.NewReader(input)
+		if err != nil {
+			return nil, err
+		}
+		return dec.IOReadCloser(), nil
+	case Uncompressed:
+		return ioutil.NopCloser(input), nil
+	default:
+		return nil, fmt.Errorf("unknown compression algorithm %q", algo)
+	}
+}
+
+// NewCompressor returns a WriteCloser which compresses everything written to it with algo
+// and writes the result to dest; Close must be called to flush trailing data.
+func NewCompressor(algo Algorithm, dest io.Writer) (io.WriteCloser, error) {
+	switch algo {
+	case Gzip:
+		return gzip.NewWriter(dest), nil
+	case Zstd:
+		return zstd.NewWriter(dest)
+	case Uncompressed:
+		return nopWriteCloser{dest}, nil
+	default:
+		return nil, fmt.Errorf("unknown compression algorithm %q", algo)
+	}
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
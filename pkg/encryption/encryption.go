@@ -0,0 +1,302 @@
+// Package encryption implements the OCI "+encrypted" layer convention: a layer is encrypted with
+// a freshly generated per-layer symmetric key, and that key is wrapped once per recipient's public
+// key and recorded in the layer descriptor's annotations so that only a holder of a matching
+// private key can recover it.
+package encryption
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"golang.org/x/crypto/openpgp"
+)
+
+// Annotation keys recorded on an encrypted layer descriptor, mirroring the convention used by
+// later encrypted-media-type implementations.
+const (
+	AnnotationKeysJWE = "org.opencontainers.image.enc.keys.jwe"
+	AnnotationPubOpts = "org.opencontainers.image.enc.pubopts"
+)
+
+// MediaTypeSuffix is appended to a layer's existing media type once it has been encrypted, e.g.
+// "application/vnd.oci.image.layer.v1.tar+gzip" becomes "...+gzip+encrypted".
+const MediaTypeSuffix = "+encrypted"
+
+// chunkSize is the size of the plaintext chunks the layer is split into before each is sealed
+// (encrypted and authenticated) independently; this bounds memory use while still letting Decrypt
+// authenticate every chunk, and the final one specifically, before releasing its plaintext.
+const chunkSize = 64 * 1024
+
+// pgpRecipient is, for now, the only supported Recipient.Type.
+const pgpRecipient = "pgp"
+
+// Recipient identifies a public key a per-layer key should be wrapped for. PublicKeyData is an
+// OpenPGP public key, either armored or binary; Type must be "pgp".
+type Recipient struct {
+	Type          string
+	PublicKeyData []byte
+}
+
+// EncryptConfig selects who a layer should be encrypted for.
+type EncryptConfig struct {
+	Recipients []Recipient
+}
+
+// DecryptConfig holds the private keys that may be able to unwrap a layer's symmetric key.
+type DecryptConfig struct {
+	KeyRing openpgp.EntityList
+}
+
+// wrappedKey is the per-recipient envelope persisted (base64-of-JSON) in AnnotationKeysJWE: Key is
+// the per-layer AES key, itself encrypted to the recipient's OpenPGP public key, so recovering it
+// requires the matching private key rather than just reading the manifest.
+type wrappedKey struct {
+	Type string `json:"type"`
+	Key  string `json:"key"`
+}
+
+// Encrypt returns a reader yielding the encrypted contents of src, plus the descriptor annotations
+// a caller must attach to the layer so Decrypt below can later recover the plaintext. Encryption
+// happens as the returned reader is consumed, so the whole layer is never buffered in memory: src
+// is split into chunkSize plaintext chunks, and each is sealed independently with AES-256-GCM, so
+// every chunk (and in particular the final one) is authenticated before Decrypt will release its
+// plaintext.
+func Encrypt(src io.Reader, config EncryptConfig) (io.ReadCloser, map[string]string, error) {
+	if len(config.Recipients) == 0 {
+		return nil, nil, fmt.Errorf("encryption was requested but no recipients were configured")
+	}
+
+	key := make([]byte, 32) // AES-256
+	if _, err := rand.Read(key); err != nil {
+		return nil, nil, fmt.Errorf("Error generating layer key: %v", err)
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	baseNonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(baseNonce); err != nil {
+		return nil, nil, fmt.Errorf("Error generating nonce: %v", err)
+	}
+
+	wrapped := make([]wrappedKey, len(config.Recipients))
+	for i, r := range config.Recipients {
+		if r.Type != pgpRecipient {
+			return nil, nil, fmt.Errorf("unsupported recipient type %q, only %q is supported", r.Type, pgpRecipient)
+		}
+		sealedKey, err := wrapKey(key, r.PublicKeyData)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Error wrapping layer key for a recipient: %v", err)
+		}
+		wrapped[i] = wrappedKey{Type: r.Type, Key: base64.StdEncoding.EncodeToString(sealedKey)}
+	}
+	wrappedJSON, err := json.Marshal(wrapped)
+	if err != nil {
+		return nil, nil, err
+	}
+	annotations := map[string]string{
+		AnnotationKeysJWE: base64.StdEncoding.EncodeToString(wrappedJSON),
+		AnnotationPubOpts: base64.StdEncoding.EncodeToString(baseNonce),
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(sealChunks(pw, src, gcm, baseNonce))
+	}()
+	return pr, annotations, nil
+}
+
+// sealChunks reads src in chunkSize plaintext chunks and writes each, length-prefixed, sealed
+// under gcm with a nonce derived from baseNonce and the chunk's index; the last chunk's
+// additional data marks it as final so Decrypt can detect a truncated ciphertext.
+func sealChunks(w io.Writer, src io.Reader, gcm cipher.AEAD, baseNonce []byte) error {
+	buf := make([]byte, chunkSize)
+	for index := uint64(0); ; index++ {
+		n, readErr := io.ReadFull(src, buf)
+		if readErr != nil && readErr != io.EOF && readErr != io.ErrUnexpectedEOF {
+			return readErr
+		}
+		last := readErr == io.EOF || readErr == io.ErrUnexpectedEOF
+		if n > 0 || last {
+			sealed := gcm.Seal(nil, chunkNonce(baseNonce, index), buf[:n], chunkAAD(index, last))
+			var length [4]byte
+			binary.BigEndian.PutUint32(length[:], uint32(len(sealed)))
+			if _, err := w.Write(length[:]); err != nil {
+				return err
+			}
+			if _, err := w.Write(sealed); err != nil {
+				return err
+			}
+		}
+		if last {
+			return nil
+		}
+	}
+}
+
+// Decrypt reverses Encrypt: given the ciphertext stream and the descriptor annotations Encrypt
+// produced, it finds a key in config.KeyRing that unwraps one of the recorded recipients and
+// returns a reader yielding the plaintext, one authenticated chunk at a time.
+func Decrypt(src io.Reader, annotations map[string]string, config DecryptConfig) (io.ReadCloser, error) {
+	wrappedB64, ok := annotations[AnnotationKeysJWE]
+	if !ok {
+		return nil, fmt.Errorf("blob is not encrypted: missing %s annotation", AnnotationKeysJWE)
+	}
+	wrappedJSON, err := base64.StdEncoding.DecodeString(wrappedB64)
+	if err != nil {
+		return nil, fmt.Errorf("Error decoding %s annotation: %v", AnnotationKeysJWE, err)
+	}
+	var wrapped []wrappedKey
+	if err := json.Unmarshal(wrappedJSON, &wrapped); err != nil {
+		return nil, err
+	}
+	nonceB64, ok := annotations[AnnotationPubOpts]
+	if !ok {
+		return nil, fmt.Errorf("blob is not encrypted: missing %s annotation", AnnotationPubOpts)
+	}
+	baseNonce, err := base64.StdEncoding.DecodeString(nonceB64)
+	if err != nil {
+		return nil, fmt.Errorf("Error decoding %s annotation: %v", AnnotationPubOpts, err)
+	}
+
+	key, err := findUsableKey(wrapped, config)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(openChunks(pw, src, gcm, baseNonce))
+	}()
+	return pr, nil
+}
+
+// openChunks is the reverse of sealChunks: it authenticates and writes out each chunk's plaintext
+// in turn, and fails if the stream ends without ever having authenticated a chunk marked final
+// (a truncated ciphertext).
+func openChunks(w io.Writer, src io.Reader, gcm cipher.AEAD, baseNonce []byte) error {
+	for index := uint64(0); ; index++ {
+		var length [4]byte
+		if _, err := io.ReadFull(src, length[:]); err != nil {
+			if err == io.EOF {
+				return fmt.Errorf("encrypted stream ended before its final chunk was seen: truncated or tampered with")
+			}
+			return err
+		}
+		sealed := make([]byte, binary.BigEndian.Uint32(length[:]))
+		if _, err := io.ReadFull(src, sealed); err != nil {
+			return err
+		}
+		for _, last := range []bool{false, true} {
+			plain, err := gcm.Open(nil, chunkNonce(baseNonce, index), sealed, chunkAAD(index, last))
+			if err == nil {
+				if _, err := w.Write(plain); err != nil {
+					return err
+				}
+				if last {
+					return nil
+				}
+				break
+			} else if last {
+				return fmt.Errorf("Error authenticating encrypted chunk %d: %v", index, err)
+			}
+		}
+	}
+}
+
+// newGCM builds an AES-256-GCM AEAD for key.
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// chunkNonce derives a unique per-chunk nonce from baseNonce and index by XORing index into its
+// low-order bytes.
+func chunkNonce(baseNonce []byte, index uint64) []byte {
+	nonce := make([]byte, len(baseNonce))
+	copy(nonce, baseNonce)
+	var indexBytes [8]byte
+	binary.BigEndian.PutUint64(indexBytes[:], index)
+	for i := 0; i < len(indexBytes) && i < len(nonce); i++ {
+		nonce[len(nonce)-1-i] ^= indexBytes[len(indexBytes)-1-i]
+	}
+	return nonce
+}
+
+// chunkAAD binds a chunk's authentication tag to its position in the stream and to whether it is
+// the final chunk, so chunks cannot be reordered, duplicated, or silently dropped from the end.
+func chunkAAD(index uint64, last bool) []byte {
+	aad := make([]byte, 9)
+	binary.BigEndian.PutUint64(aad, index)
+	if last {
+		aad[8] = 1
+	}
+	return aad
+}
+
+// wrapKey encrypts key to the OpenPGP public key in publicKeyData (armored or binary), producing
+// an OpenPGP message only the matching private key can open.
+func wrapKey(key []byte, publicKeyData []byte) ([]byte, error) {
+	entities, err := openpgp.ReadKeyRing(bytes.NewReader(publicKeyData))
+	if err != nil {
+		entities, err = openpgp.ReadArmoredKeyRing(bytes.NewReader(publicKeyData))
+		if err != nil {
+			return nil, fmt.Errorf("Error reading recipient public key: %v", err)
+		}
+	}
+	if len(entities) == 0 {
+		return nil, fmt.Errorf("no public key found in recipient key data")
+	}
+	var buf bytes.Buffer
+	w, err := openpgp.Encrypt(&buf, entities, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(key); err != nil {
+		w.Close()
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// findUsableKey returns the first layer key in wrapped that a private key in config.KeyRing can
+// unwrap.
+func findUsableKey(wrapped []wrappedKey, config DecryptConfig) ([]byte, error) {
+	for _, w := range wrapped {
+		if w.Type != pgpRecipient {
+			continue
+		}
+		sealedKey, err := base64.StdEncoding.DecodeString(w.Key)
+		if err != nil {
+			continue
+		}
+		md, err := openpgp.ReadMessage(bytes.NewReader(sealedKey), config.KeyRing, nil, nil)
+		if err != nil {
+			continue // not wrapped for any key in this keyring
+		}
+		key, err := ioutil.ReadAll(md.UnverifiedBody)
+		if err != nil {
+			continue
+		}
+		return key, nil
+	}
+	return nil, fmt.Errorf("none of the configured private keys can decrypt this layer")
+}
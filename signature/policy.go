@@ -0,0 +1,188 @@
+package signature
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	"golang.org/x/crypto/openpgp"
+)
+
+// defaultPolicyPath is where policy is read from unless a caller overrides it, matching the path
+// distributions ship /etc/containers/policy.json at.
+const defaultPolicyPath = "/etc/containers/policy.json"
+
+// Policy decides, per transport and scope (e.g. a registry host, or host/repository), whether an
+// image is acceptable and which signatures (if any) it must carry.
+type Policy struct {
+	Default    PolicyRequirements                `json:"default"`
+	Transports map[string]PolicyTransportScopes `json:"transports,omitempty"`
+}
+
+// PolicyTransportScopes maps a scope string (transport-defined, e.g. "docker.io/library/busybox"
+// or "" for "any scope of this transport") to the requirements for images in that scope.
+type PolicyTransportScopes map[string]PolicyRequirements
+
+// PolicyRequirements is an ordered list of requirements; an image must satisfy all of them.
+type PolicyRequirements []PolicyRequirement
+
+// PolicyRequirement is a single thing an image must satisfy: being explicitly rejected, being
+// accepted unconditionally, or carrying a signature by one of a set of keys.
+type PolicyRequirement interface {
+	// isSatisfied decides whether signaturesForScope (the signatures GetSignatures returned for
+	// this image) satisfy this requirement, given the image's manifest and the Docker reference
+	// the copy was requested as.
+	isSatisfied(dockerReference string, manifestDigest string, signaturesForScope [][]byte) (bool, error)
+}
+
+// prInsecureAcceptAnything accepts any image without checking signatures at all.
+type prInsecureAcceptAnything struct{}
+
+func (prInsecureAcceptAnything) isSatisfied(string, string, [][]byte) (bool, error) {
+	return true, nil
+}
+
+// prReject rejects every image in its scope outright.
+type prReject struct{}
+
+func (prReject) isSatisfied(string, string, [][]byte) (bool, error) {
+	return false, nil
+}
+
+// prSignedBy accepts an image if at least one of its signatures verifies against KeyRing and
+// attests to both the manifest digest being copied and the Docker reference it is copied as.
+type prSignedBy struct {
+	KeyRing openpgp.EntityList
+}
+
+func (pr prSignedBy) isSatisfied(dockerReference, manifestDigest string, signaturesForScope [][]byte) (bool, error) {
+	for _, sig := range signaturesForScope {
+		identity, err := Verify(sig, pr.KeyRing)
+		if err != nil {
+			continue // an unverifiable or foreign-keyed signature just doesn't satisfy this requirement
+		}
+		if identity.DockerManifestDigest == manifestDigest && identity.DockerReference == dockerReference {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// policyJSON and the prJSON/* types below are the on-disk JSON shape of Policy and
+// PolicyRequirement, resolved into the interface values above by UnmarshalJSON.
+type policyJSON struct {
+	Default    []prJSON                       `json:"default"`
+	Transports map[string]map[string][]prJSON `json:"transports,omitempty"`
+}
+
+type prJSON struct {
+	Type    string `json:"type"`
+	KeyPath string `json:"keyPath,omitempty"`
+}
+
+func (pr prJSON) toPolicyRequirement() (PolicyRequirement, error) {
+	switch pr.Type {
+	case "insecureAcceptAnything":
+		return prInsecureAcceptAnything{}, nil
+	case "reject":
+		return prReject{}, nil
+	case "signedBy":
+		if pr.KeyPath == "" {
+			return nil, fmt.Errorf("signedBy requirement is missing keyPath")
+		}
+		keyring, err := ReadKeyRing(pr.KeyPath)
+		if err != nil {
+			return nil, err
+		}
+		return prSignedBy{KeyRing: keyring}, nil
+	default:
+		return nil, fmt.Errorf("unknown policy requirement type %q", pr.Type)
+	}
+}
+
+func toPolicyRequirements(in []prJSON) (PolicyRequirements, error) {
+	out := make(PolicyRequirements, 0, len(in))
+	for _, pr := range in {
+		req, err := pr.toPolicyRequirement()
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, req)
+	}
+	return out, nil
+}
+
+// DefaultPolicy reads and parses the policy at /etc/containers/policy.json.
+func DefaultPolicy() (*Policy, error) {
+	return NewPolicyFromFile(defaultPolicyPath)
+}
+
+// NewPolicyFromFile reads and parses the policy at path.
+func NewPolicyFromFile(path string) (*Policy, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var raw policyJSON
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("Error parsing policy %s: %v", path, err)
+	}
+
+	def, err := toPolicyRequirements(raw.Default)
+	if err != nil {
+		return nil, err
+	}
+	policy := &Policy{Default: def}
+	if len(raw.Transports) > 0 {
+		policy.Transports = map[string]PolicyTransportScopes{}
+		for transport, scopes := range raw.Transports {
+			scopeMap := PolicyTransportScopes{}
+			for scope, reqs := range scopes {
+				parsed, err := toPolicyRequirements(reqs)
+				if err != nil {
+					return nil, err
+				}
+				scopeMap[scope] = parsed
+			}
+			policy.Transports[transport] = scopeMap
+		}
+	}
+	return policy, nil
+}
+
+// requirementsFor returns the requirements that apply to scope within transport, falling back to
+// the "" (any scope) entry and finally to the policy-wide default, most specific match first.
+func (p *Policy) requirementsFor(transport, scope string) PolicyRequirements {
+	if scopes, ok := p.Transports[transport]; ok {
+		if reqs, ok := scopes[scope]; ok {
+			return reqs
+		}
+		if reqs, ok := scopes[""]; ok {
+			return reqs
+		}
+	}
+	return p.Default
+}
+
+// IsImageAllowed decides whether an image with manifestDigest, signed with signaturesForScope and
+// being copied as dockerReference into scope within transport, may be copied. A caller copying an
+// image between an ImageSource and an ImageDestination MUST call this (with the signatures
+// GetSignatures returned) before calling PutManifest on the destination, and refuse the copy if it
+// returns false or an error: nothing in this package or in the ImageDestination/ImageSource
+// interfaces enforces that on its own, since no such copy driver exists in this tree yet.
+func (p *Policy) IsImageAllowed(transport, scope, dockerReference, manifestDigest string, signaturesForScope [][]byte) (bool, error) {
+	reqs := p.requirementsFor(transport, scope)
+	if len(reqs) == 0 {
+		return false, fmt.Errorf("no policy requirements configured for %s:%s, refusing to guess", transport, scope)
+	}
+	for _, req := range reqs {
+		ok, err := req.isSatisfied(dockerReference, manifestDigest, signaturesForScope)
+		if err != nil {
+			return false, err
+		}
+		if !ok {
+			return false, nil
+		}
+	}
+	return true, nil
+}
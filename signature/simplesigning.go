@@ -0,0 +1,126 @@
+// Package signature implements creation and verification of the "simple signing" format: a JSON
+// payload binding a manifest digest to the Docker reference it was pushed as, wrapped in a
+// detached PGP signature.
+package signature
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	"golang.org/x/crypto/openpgp"
+)
+
+// simpleSigningPayload is the JSON payload that gets PGP-signed. Field names and nesting match
+// the payload format other implementations of "simple signing" produce; the signature blob around
+// it is this package's own payload-plus-detached-signature envelope (see Sign), which is the only
+// form Verify accepts.
+type simpleSigningPayload struct {
+	Critical criticalPayload  `json:"critical"`
+	Optional *optionalPayload `json:"optional,omitempty"`
+}
+
+type criticalPayload struct {
+	Identity criticalIdentity `json:"identity"`
+	Image    criticalImage    `json:"image"`
+	Type     string           `json:"type"`
+}
+
+type criticalIdentity struct {
+	DockerReference string `json:"docker-reference"`
+}
+
+type criticalImage struct {
+	DockerManifestDigest string `json:"docker-manifest-digest"`
+}
+
+type optionalPayload struct {
+	Creator   string `json:"creator,omitempty"`
+	Timestamp int64  `json:"timestamp,omitempty"`
+}
+
+const simpleSigningType = "atomic container signature"
+
+// Sign creates a simple-signing payload binding manifestDigest to dockerReference, and returns it
+// wrapped in a detached, armored-free PGP signature produced with signingKey (the first usable
+// private key in signingKey is used).
+func Sign(manifestDigest, dockerReference string, signingKey *openpgp.Entity) ([]byte, error) {
+	payload := simpleSigningPayload{
+		Critical: criticalPayload{
+			Type:     simpleSigningType,
+			Identity: criticalIdentity{DockerReference: dockerReference},
+			Image:    criticalImage{DockerManifestDigest: manifestDigest},
+		},
+	}
+	payloadBytes, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	var signed bytes.Buffer
+	if err := openpgp.DetachSign(&signed, signingKey, bytes.NewReader(payloadBytes), nil); err != nil {
+		return nil, fmt.Errorf("Error signing manifest: %v", err)
+	}
+
+	// The signature blob we persist is the payload followed by its detached signature, so that a
+	// single opaque []byte is enough for Verify to check both the signature and recover the claims
+	// it covers, without the caller having to separately ship the payload.
+	envelope := struct {
+		Payload   []byte `json:"payload"`
+		Signature []byte `json:"signature"`
+	}{
+		Payload:   payloadBytes,
+		Signature: signed.Bytes(),
+	}
+	return json.Marshal(envelope)
+}
+
+// VerifiedIdentity is the (dockerReference, manifestDigest) pair a signature, once verified,
+// attests to.
+type VerifiedIdentity struct {
+	DockerReference      string
+	DockerManifestDigest string
+}
+
+// Verify checks that signatureBlob (as produced by Sign) is a valid PGP signature by one of the
+// keys in keyring, and returns the identity it attests to.
+func Verify(signatureBlob []byte, keyring openpgp.EntityList) (*VerifiedIdentity, error) {
+	var envelope struct {
+		Payload   []byte `json:"payload"`
+		Signature []byte `json:"signature"`
+	}
+	if err := json.Unmarshal(signatureBlob, &envelope); err != nil {
+		return nil, fmt.Errorf("Error parsing signature: %v", err)
+	}
+
+	if _, err := openpgp.CheckDetachedSignature(keyring, bytes.NewReader(envelope.Payload), bytes.NewReader(envelope.Signature)); err != nil {
+		return nil, fmt.Errorf("Error verifying signature: %v", err)
+	}
+
+	var payload simpleSigningPayload
+	if err := json.Unmarshal(envelope.Payload, &payload); err != nil {
+		return nil, fmt.Errorf("Error parsing signed payload: %v", err)
+	}
+	if payload.Critical.Type != simpleSigningType {
+		return nil, fmt.Errorf("Unrecognized signature type %q", payload.Critical.Type)
+	}
+	return &VerifiedIdentity{
+		DockerReference:      payload.Critical.Identity.DockerReference,
+		DockerManifestDigest: payload.Critical.Image.DockerManifestDigest,
+	}, nil
+}
+
+// ReadKeyRing loads an OpenPGP keyring (public or private) from path, e.g. a GPG exported keyring
+// used either to sign or to populate a "signedBy" policy requirement's key store.
+func ReadKeyRing(path string) (openpgp.EntityList, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	keyring, err := openpgp.ReadKeyRing(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("Error reading keyring %s: %v", path, err)
+	}
+	return keyring, nil
+}
@@ -0,0 +1,138 @@
+// Package types defines the interfaces shared by every transport (docker, docker-archive,
+// docker-daemon, oci, directory, ...): the way a caller parses a reference, opens a source or
+// destination for it, and copies blobs, manifests and signatures between them.
+package types
+
+import (
+	"io"
+
+	"github.com/containers/image/pkg/blobinfocache"
+	"github.com/containers/image/pkg/compression"
+	"github.com/containers/image/pkg/encryption"
+	"github.com/containers/image/reference"
+)
+
+// ImageTransport is a protocol for transferring container images, identified by a name.
+type ImageTransport interface {
+	// Name returns the name of the transport, which must be unique among all transports.
+	Name() string
+	// ParseReference converts a string, which should not start with the ImageTransport.Name prefix,
+	// into an ImageReference.
+	ParseReference(reference string) (ImageReference, error)
+}
+
+// ImageReference is an abstracted way to refer to an image location, within a transport.
+type ImageReference interface {
+	Transport() ImageTransport
+	// StringWithinTransport returns a string representation of the reference, which MUST be such
+	// that reference.Transport().ParseReference(reference.StringWithinTransport()) returns an
+	// equivalent reference.
+	StringWithinTransport() string
+	// DockerReference returns a Docker reference associated with this reference, or nil if this
+	// reference does not correspond to a Docker one.
+	DockerReference() reference.Named
+	NewImage(certPath string, tlsVerify bool) (Image, error)
+	NewImageSource(certPath string, tlsVerify bool) (ImageSource, error)
+	NewImageDestination(certPath string, tlsVerify bool) (ImageDestination, error)
+	DeleteImage(certPath string, tlsVerify bool) error
+}
+
+// ImageSource is a container image reference opened for reading.
+type ImageSource interface {
+	Reference() ImageReference
+	// IntendedDockerReference returns the full, unambiguous, Docker reference for this image, _as
+	// specified by the user_ (not as the image itself, or its underlying storage, claims). This
+	// can be used e.g. to determine which public keys are trusted for this image. May be "" if
+	// unknown.
+	IntendedDockerReference() string
+	// GetManifest returns the image's manifest along with its MIME type (which may be empty when
+	// it can't be determined but the manifest is available). It may use a remote (= slow) service.
+	// If the manifest is, in fact, not available at this repository, or if mimetype is not one of
+	// the requested mimetypes, an error should be returned.
+	GetManifest(mimetypes []string) ([]byte, string, error)
+	GetBlob(digest string) (io.ReadCloser, int64, error)
+	GetSignatures() ([][]byte, error)
+	// Delete image from registry, if operation is supported
+	Delete() error
+}
+
+// ImageDestination is a container image reference opened for writing.
+type ImageDestination interface {
+	Reference() ImageReference
+	// SupportedManifestMIMETypes tells which manifest mime types the destination supports, in
+	// preference order; an empty slice or nil means any type can be tried.
+	SupportedManifestMIMETypes() []string
+	// PutBlob writes contents of stream as a blob, and returns its digest and size. digest can be
+	// "" if the digest of the blob is not known in advance (in which case PutBlob computes it
+	// itself); if it is provided, it is not necessarily verified against the stream's contents.
+	PutBlob(stream io.Reader, digest string, options PutBlobOptions) (string, int64, error)
+	PutManifest(manifest []byte) error
+	PutSignatures(signatures [][]byte) error
+}
+
+// PutBlobOptions further configures a single PutBlob call.
+type PutBlobOptions struct {
+	// DesiredCompression, if not compression.Uncompressed, asks PutBlob to recompress the stream
+	// on the fly to this algorithm (regardless of the compression, if any, the input stream
+	// already uses).
+	DesiredCompression compression.Algorithm
+	// Cache, if not nil, is consulted and updated with the locations blobs are known to already
+	// exist at, so PutBlob can skip re-uploading/re-copying a blob its caller already pushed
+	// somewhere reachable from this destination.
+	Cache blobinfocache.BlobInfoCache
+	// Encrypt, if not nil, asks PutBlob to encrypt the blob for these recipients as it is written;
+	// EncryptAnnotations, if set, receives the descriptor annotations the caller must record on
+	// the layer alongside the encrypted blob so it can later be decrypted.
+	Encrypt            *encryption.EncryptConfig
+	EncryptAnnotations *map[string]string
+	// DiffID, if not nil, receives the digest of stream's decompressed contents (the same value
+	// the image's config rootfs.DiffIDs entry for this layer must match), so a caller building
+	// that config doesn't have to decompress and hash the layer a second time itself.
+	DiffID *string
+}
+
+// BlobInfo collects known information about a blob (a layer or a config object). Only Digest is
+// guaranteed to be set; Size may be -1 if unknown.
+type BlobInfo struct {
+	Digest string
+	Size   int64
+}
+
+// ManifestUpdateInformation carries information a genericManifest.UpdatedImage implementation
+// needs but does not need to compute on its own, because the caller (typically a copy operation)
+// already has it.
+type ManifestUpdateInformation struct {
+	Destination  ImageDestination
+	LayerDiffIDs []string
+}
+
+// ManifestUpdateOptions describes how to update a manifest; see genericManifest.UpdatedImage.
+type ManifestUpdateOptions struct {
+	LayerInfos      []BlobInfo
+	InformationOnly ManifestUpdateInformation
+}
+
+// ImageInspectInfo is a set of metadata describing Image, as returned by Image.Inspect.
+type ImageInspectInfo struct {
+	Tag           string
+	Created       string
+	DockerVersion string
+	Labels        map[string]string
+	Architecture  string
+	Os            string
+	Layers        []string
+}
+
+// Image is a parsed, possibly-multi-manifest-aware view of an image: its manifest, configuration
+// and layers, with enough structure to inspect and rewrite it.
+type Image interface {
+	Reference() ImageReference
+	Manifest() ([]byte, string, error)
+	Signatures() ([][]byte, error)
+	ConfigInfo() BlobInfo
+	ConfigBlob() ([]byte, error)
+	LayerInfos() []BlobInfo
+	Inspect() (*ImageInspectInfo, error)
+	UpdatedImageNeedsLayerDiffIDs(options ManifestUpdateOptions) bool
+	UpdatedImage(options ManifestUpdateOptions) (Image, error)
+}